@@ -4,10 +4,16 @@ import (
 	"context"
 
 	"github.com/bitrvmpd/goquark/internal/pkg/quark"
+	"github.com/bitrvmpd/goquark/internal/pkg/usb"
 	"github.com/spf13/cobra"
 )
 
+var runOpts = usb.DefaultOptions
+
 func init() {
+	runCmd.Flags().DurationVar(&runOpts.ReadTimeout, "read-timeout", runOpts.ReadTimeout, "Maximum time a USB read may take once started, 0 waits forever")
+	runCmd.Flags().DurationVar(&runOpts.WriteTimeout, "write-timeout", runOpts.WriteTimeout, "Maximum time a USB write may take, 0 waits forever")
+	runCmd.Flags().BoolVar(&runOpts.ReadOnly, "read-only", runOpts.ReadOnly, "Refuses creating, deleting, renaming and writing files")
 	rootCmd.AddCommand(runCmd)
 }
 
@@ -19,6 +25,7 @@ var runCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := context.Background()
 		//ctx, cancel := context.WithCancel(ctx)
-		quark.Listen(ctx)
+		w := usb.NewWatcher(ctx)
+		quark.Listen(ctx, w, usb.NewManager(ctx, w, runOpts))
 	},
 }
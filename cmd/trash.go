@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/cfg"
+	"github.com/bitrvmpd/goquark/internal/pkg/fs"
+	"github.com/bitrvmpd/goquark/internal/pkg/trash"
+	"github.com/spf13/cobra"
+)
+
+var olderThan time.Duration
+
+func init() {
+	trashEmptyCmd.Flags().DurationVar(&olderThan, "older-than", 0, "Only removes items deleted longer ago than this, 0 removes everything")
+	trashCmd.AddCommand(trashListCmd, trashRestoreCmd, trashEmptyCmd)
+	rootCmd.AddCommand(trashCmd)
+}
+
+var trashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "Manages what Goldleaf deleted",
+	Long: `Goldleaf's deletions are moved to the trash of the folder they were in.
+	They can be listed, restored or removed for good from there`,
+}
+
+var trashListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the deleted items of every folder",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tDELETED\tSERIAL\tPATH")
+		for _, t := range trashes() {
+			entries, err := t.List()
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", e.ID, e.Deleted.Format(time.RFC3339), e.Serial, e.Path)
+			}
+		}
+		return w.Flush()
+	},
+}
+
+var trashRestoreCmd = &cobra.Command{
+	Use:   "restore ID...",
+	Short: "Moves deleted items back where they were",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, id := range args {
+			e, err := restore(id)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Restored %v\n", e.Path)
+		}
+		return nil
+	},
+}
+
+var trashEmptyCmd = &cobra.Command{
+	Use:   "empty",
+	Short: "Removes deleted items for good",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, t := range trashes() {
+			n, err := t.Purge(time.Now().Add(-olderThan))
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				fmt.Printf("Removed %v items from %v\n", n, t.Dir())
+			}
+		}
+		return nil
+	},
+}
+
+// Returns the trash of every configured folder.
+func trashes() []*trash.Trash {
+	var ts []*trash.Trash
+	for _, f := range cfg.AllFolders() {
+		ts = append(ts, trash.New(fs.OS, f.TrashDir()))
+	}
+	return ts
+}
+
+// Restores id from whichever trash holds it.
+func restore(id string) (trash.Entry, error) {
+	for _, t := range trashes() {
+		e, err := t.Restore(id)
+		if !errors.Is(err, trash.ErrNotFound) {
+			return e, err
+		}
+	}
+	return trash.Entry{}, fmt.Errorf("%w: %v", trash.ErrNotFound, id)
+}
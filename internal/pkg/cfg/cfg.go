@@ -3,22 +3,112 @@ package cfg
 import (
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"time"
 
+	"github.com/bitrvmpd/goquark/internal/pkg/trash"
 	"gopkg.in/yaml.v2"
 )
 
 const ConfigPath = "goquark.yaml"
 
+// Name reported for consoles not matching any profile.
+const DefaultProfile = "default"
+
 type cfgRoot struct {
-	Nodes []cfgNode `yaml:"nodes"`
+	// Served to consoles not matching any profile.
+	Nodes    []Folder     `yaml:"nodes"`
+	Profiles []cfgProfile `yaml:"profiles,omitempty"`
+	Trash    cfgTrash     `yaml:"trash,omitempty"`
+}
+
+type cfgTrash struct {
+	// Deleted items older than this are removed for good. Zero keeps them.
+	Retention time.Duration `yaml:"retention,omitempty"`
 }
-type cfgNode struct {
+
+// Folders served to specific consoles, matched by the USB serial number
+// (Goldleaf's version) and product string. Both accept path.Match patterns,
+// empty ones match anything.
+type cfgProfile struct {
+	Name    string   `yaml:"name"`
+	Serial  string   `yaml:"serial,omitempty"`
+	Product string   `yaml:"product,omitempty"`
+	Nodes   []Folder `yaml:"nodes"`
+}
+
+// Folder exposed to Goldleaf as a special path.
+type Folder struct {
 	Alias string `yaml:"alias"`
 	Path  string `yaml:"path"`
+	// Left out, the folder is fully accessible.
+	Permissions *Permissions `yaml:"permissions,omitempty"`
+	// Where deleted items go, relative to Path unless absolute.
+	// Must be on the same filesystem. Defaults to trash.DefaultDir.
+	Trash string `yaml:"trash,omitempty"`
 	index int
 }
 
+// Returns the trash directory of f.
+func (f Folder) TrashDir() string {
+	dir := f.Trash
+	if dir == "" {
+		dir = trash.DefaultDir
+	}
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(f.Path, dir)
+}
+
+// Operations Goldleaf may do in a folder. A read-only library only sets
+// Read, a write-only inbox sets Write and Create.
+type Permissions struct {
+	Read   bool `yaml:"read"`
+	Write  bool `yaml:"write"`
+	Create bool `yaml:"create"`
+	Delete bool `yaml:"delete"`
+	Rename bool `yaml:"rename"`
+}
+
+// Op is an operation checked against Permissions.
+type Op string
+
+const (
+	OpRead   Op = "read"
+	OpWrite  Op = "write"
+	OpCreate Op = "create"
+	OpDelete Op = "delete"
+	OpRename Op = "rename"
+)
+
+var FullAccess = Permissions{Read: true, Write: true, Create: true, Delete: true, Rename: true}
+
+// Returns what Goldleaf may do in f.
+func (f Folder) Access() Permissions {
+	if f.Permissions == nil {
+		return FullAccess
+	}
+	return *f.Permissions
+}
+
+func (p Permissions) Allows(op Op) bool {
+	switch op {
+	case OpRead:
+		return p.Read
+	case OpWrite:
+		return p.Write
+	case OpCreate:
+		return p.Create
+	case OpDelete:
+		return p.Delete
+	case OpRename:
+		return p.Rename
+	}
+	return false
+}
+
 var cfg cfgRoot = cfgRoot{}
 
 func init() {
@@ -48,6 +138,11 @@ func loadConfig() {
 	for i := 0; i < len(cfg.Nodes); i++ {
 		cfg.Nodes[i].index = i
 	}
+	for _, p := range cfg.Profiles {
+		for i := 0; i < len(p.Nodes); i++ {
+			p.Nodes[i].index = i
+		}
+	}
 }
 
 func writeConfig() {
@@ -77,7 +172,7 @@ func Size() uint32 {
 }
 
 func AddFolder(name string, path string) {
-	cfg.Nodes = append(cfg.Nodes, cfgNode{name, path, len(cfg.Nodes)})
+	cfg.Nodes = append(cfg.Nodes, Folder{Alias: name, Path: path, index: len(cfg.Nodes)})
 	writeConfig()
 }
 
@@ -91,6 +186,62 @@ func RemoveFolder(idx int) {
 	writeConfig()
 }
 
-func ListFolders() []cfgNode {
+func ListFolders() []Folder {
 	return cfg.Nodes
 }
+
+// Returns the folders of every profile, default one included,
+// once per path.
+func AllFolders() []Folder {
+	return cfg.allFolders()
+}
+
+func (r *cfgRoot) allFolders() []Folder {
+	seen := map[string]bool{}
+	var folders []Folder
+	add := func(nodes []Folder) {
+		for _, f := range nodes {
+			if !seen[f.Path] {
+				seen[f.Path] = true
+				folders = append(folders, f)
+			}
+		}
+	}
+	add(r.Nodes)
+	for _, p := range r.Profiles {
+		add(p.Nodes)
+	}
+	return folders
+}
+
+// How long deleted items are kept, zero keeps them forever.
+func TrashRetention() time.Duration {
+	return cfg.Trash.Retention
+}
+
+// Returns the name of the profile matching the console and its folders.
+// Consoles without a matching profile get DefaultProfile and ListFolders.
+func FoldersFor(serial string, product string) (string, []Folder) {
+	return cfg.foldersFor(serial, product)
+}
+
+func (r *cfgRoot) foldersFor(serial string, product string) (string, []Folder) {
+	for _, p := range r.Profiles {
+		if matches(p.Serial, serial) && matches(p.Product, product) {
+			return p.Name, p.Nodes
+		}
+	}
+	return DefaultProfile, r.Nodes
+}
+
+func matches(pattern string, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, err := path.Match(pattern, s)
+	if err != nil {
+		log.Printf("ERROR: Invalid pattern %q in %v. %v", pattern, ConfigPath, err)
+		return false
+	}
+	return ok
+}
@@ -0,0 +1,140 @@
+package cfg
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const testConfig = `
+nodes:
+  - alias: Library
+    path: /games
+profiles:
+  - name: qa
+    serial: "0.10.*"
+    product: Goldleaf
+    nodes:
+      - alias: QA builds
+        path: /builds/qa
+  - name: legacy
+    serial: "0.8.0"
+    nodes:
+      - alias: Old
+        path: /games/old
+`
+
+func TestFoldersFor(t *testing.T) {
+	var r cfgRoot
+	if err := yaml.Unmarshal([]byte(testConfig), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serial  string
+		product string
+		profile string
+		path    string
+	}{
+		{"0.10.0", "Goldleaf", "qa", "/builds/qa"},
+		{"0.10.0", "Other", DefaultProfile, "/games"},
+		{"0.8.0", "Goldleaf", "legacy", "/games/old"},
+		{"1.0.0", "Goldleaf", DefaultProfile, "/games"},
+	}
+
+	for _, tt := range tests {
+		name, nodes := r.foldersFor(tt.serial, tt.product)
+		if name != tt.profile || len(nodes) != 1 || nodes[0].Path != tt.path {
+			t.Errorf("foldersFor(%q, %q) = %v %v, want %v %v", tt.serial, tt.product, name, nodes, tt.profile, tt.path)
+		}
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	const config = `
+nodes:
+  - alias: Library
+    path: /games
+    permissions:
+      read: true
+  - alias: Dumps
+    path: /dumps
+    permissions:
+      write: true
+      create: true
+  - alias: Everything
+    path: /everything
+`
+	var r cfgRoot
+	if err := yaml.Unmarshal([]byte(config), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []Op{OpRead, OpWrite, OpCreate, OpDelete, OpRename}
+	want := map[string][]bool{
+		"Library":    {true, false, false, false, false},
+		"Dumps":      {false, true, true, false, false},
+		"Everything": {true, true, true, true, true},
+	}
+	for _, f := range r.Nodes {
+		for i, op := range ops {
+			if got := f.Access().Allows(op); got != want[f.Alias][i] {
+				t.Errorf("%v allows %v: got %v, want %v", f.Alias, op, got, want[f.Alias][i])
+			}
+		}
+	}
+
+	// Folders without permissions are written back without them.
+	b, err := yaml.Marshal(r.Nodes[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "alias: Everything\npath: /everything\n" {
+		t.Errorf("got %q", b)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	const config = `
+trash:
+  retention: 720h
+nodes:
+  - alias: Library
+    path: /games
+  - alias: Dumps
+    path: /dumps
+    trash: deleted
+profiles:
+  - name: qa
+    nodes:
+      - alias: Library
+        path: /games
+      - alias: QA builds
+        path: /builds/qa
+        trash: /builds/.trash
+`
+	var r cfgRoot
+	if err := yaml.Unmarshal([]byte(config), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Trash.Retention != 720*time.Hour {
+		t.Errorf("got retention %v", r.Trash.Retention)
+	}
+
+	folders := r.allFolders()
+	want := map[string]string{
+		"/games":     "/games/.goquark-trash",
+		"/dumps":     "/dumps/deleted",
+		"/builds/qa": "/builds/.trash",
+	}
+	if len(folders) != len(want) {
+		t.Fatalf("got folders %v", folders)
+	}
+	for _, f := range folders {
+		if got := f.TrashDir(); got != filepath.FromSlash(want[f.Path]) {
+			t.Errorf("%v trashes to %v, want %v", f.Path, got, want[f.Path])
+		}
+	}
+}
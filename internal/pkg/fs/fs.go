@@ -1,10 +1,13 @@
 package fs
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 )
 
 var (
@@ -41,10 +44,103 @@ func GetDriveLabel(drive string) (string, error) {
 	return "Home root", nil
 }
 
+// FS backs the folders served to Goldleaf. Paths are absolute and
+// errors are *os.PathError, like the os package ones.
+type FS interface {
+	Stat(name string) (os.FileInfo, error)
+	// Returns the entries of a directory sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	// Opens a file for reading.
+	Open(name string) (File, error)
+	// Opens a file with the os.O_* flags, creating it with perm if asked to.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// Creates or truncates a file, opened for reading and writing.
+	Create(name string) (File, error)
+	Mkdir(name string, perm os.FileMode) error
+	// Removes a file or an empty directory.
+	Remove(name string) error
+	Rename(oldname string, newname string) error
+}
+
+// File is an open file of a FS.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	// Flushes what was written to storage.
+	Sync() error
+}
+
+// Implemented by filesystems having symbolic links,
+// so they can't be used to leave a served folder.
+type Linker interface {
+	EvalSymlinks(name string) (string, error)
+	Lstat(name string) (os.FileInfo, error)
+}
+
+// Creates a directory along with any missing parent.
+func MkdirAll(fsys FS, path string, perm os.FileMode) error {
+	fi, err := fsys.Stat(path)
+	if err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+	}
+
+	if parent := filepath.Dir(path); parent != path {
+		if err := MkdirAll(fsys, parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := fsys.Mkdir(path, perm); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Removes path and everything inside it. A missing path isn't an error.
+func RemoveAll(fsys FS, path string) error {
+	fi, err := fsys.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		entries, err := fsys.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := RemoveAll(fsys, filepath.Join(path, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return fsys.Remove(path)
+}
+
+// Returns the contents of a file.
+func ReadFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
 // Returns all files inside the specified directory
-func GetFilesIn(path string) ([]string, error) {
+func GetFilesIn(fsys FS, path string) ([]string, error) {
 	files := []string{}
-	f, err := ioutil.ReadDir(path)
+	f, err := fsys.ReadDir(path)
 	if err != nil {
 		return nil, err
 	}
@@ -60,9 +156,9 @@ func GetFilesIn(path string) ([]string, error) {
 }
 
 // Returns all directories inside the specified path
-func GetDirectoriesIn(path string) ([]string, error) {
+func GetDirectoriesIn(fsys FS, path string) ([]string, error) {
 	dirs := []string{}
-	f, err := ioutil.ReadDir(path)
+	f, err := fsys.ReadDir(path)
 	if err != nil {
 		return nil, err
 	}
@@ -94,12 +190,3 @@ func DenormalizePath(path string) string {
 	}
 	return strings.ReplaceAll(path, "/", "\\\\")
 }
-
-// Deletes specified path and all its contents
-func DeletePath(path string) error {
-	err := os.RemoveAll(path)
-	if err != nil {
-		return err
-	}
-	return nil
-}
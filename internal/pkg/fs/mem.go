@@ -0,0 +1,367 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemFS is a filesystem kept in memory, without links nor permissions.
+// Safe for concurrent use.
+type MemFS struct {
+	mu sync.Mutex
+	// By clean path. Roots, like "/", aren't stored and always exist.
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	dir     bool
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{nodes: map[string]*memNode{}}
+}
+
+func isRoot(name string) bool {
+	return filepath.Dir(name) == name
+}
+
+// Returns the node at the clean path name. Must be called with m.mu held.
+func (m *MemFS) lookup(name string) (*memNode, bool) {
+	if isRoot(name) {
+		return &memNode{dir: true, mode: os.ModeDir | 0755}, true
+	}
+	n, ok := m.nodes[name]
+	return n, ok
+}
+
+// Fails unless the parent of name is a directory. Must be called with m.mu held.
+func (m *MemFS) checkParent(op string, name string) error {
+	parent, ok := m.lookup(filepath.Dir(name))
+	if !ok {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if !parent.dir {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	n, ok := m.lookup(name)
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return n.info(name), nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	n, ok := m.lookup(name)
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if !n.dir {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	var infos []os.FileInfo
+	for p, child := range m.nodes {
+		if filepath.Dir(p) == name && p != name {
+			infos = append(infos, child.info(p))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFS) Create(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	n, ok := m.lookup(name)
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case ok && n.dir && writable:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if err := m.checkParent("open", name); err != nil {
+			return nil, err
+		}
+		n = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		m.nodes[name] = n
+	}
+
+	if ok && writable && flag&os.O_TRUNC != 0 {
+		n.data = nil
+		n.modTime = time.Now()
+	}
+	return &memFile{fs: m, node: n, name: name, flag: flag}, nil
+}
+
+func (m *MemFS) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := m.lookup(name); ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := m.checkParent("mkdir", name); err != nil {
+		return err
+	}
+	m.nodes[name] = &memNode{dir: true, mode: os.ModeDir | perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	n, ok := m.lookup(name)
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if isRoot(name) || n.dir && m.hasChildren(name) {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+// Must be called with m.mu held.
+func (m *MemFS) hasChildren(name string) bool {
+	for p := range m.nodes {
+		if filepath.Dir(p) == name && p != name {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces newname if it's a file or an empty directory, like on Unix.
+func (m *MemFS) Rename(oldname string, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	fail := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	n, ok := m.lookup(oldname)
+	if !ok {
+		return fail(os.ErrNotExist)
+	}
+	if oldname == newname {
+		return nil
+	}
+	if isRoot(oldname) || strings.HasPrefix(newname, oldname+string(filepath.Separator)) {
+		return fail(syscall.EINVAL)
+	}
+	if err := m.checkParent("rename", newname); err != nil {
+		return fail(err.(*os.PathError).Err)
+	}
+	if old, ok := m.lookup(newname); ok {
+		switch {
+		case old.dir && !n.dir:
+			return fail(syscall.EISDIR)
+		case !old.dir && n.dir:
+			return fail(syscall.ENOTDIR)
+		case old.dir && m.hasChildren(newname):
+			return fail(syscall.ENOTEMPTY)
+		}
+	}
+
+	// Directories take everything inside along.
+	prefix := oldname + string(filepath.Separator)
+	for p, child := range m.nodes {
+		if strings.HasPrefix(p, prefix) {
+			delete(m.nodes, p)
+			m.nodes[newname+string(filepath.Separator)+p[len(prefix):]] = child
+		}
+	}
+	delete(m.nodes, oldname)
+	m.nodes[newname] = n
+	return nil
+}
+
+// Sets the size of the file at n, what's added reads as zeros. Capacity grows
+// geometrically, so files written a chunk at a time aren't copied each time.
+func (n *memNode) resize(size int64) {
+	old := int64(len(n.data))
+	switch {
+	case size <= old:
+		n.data = n.data[:size]
+	case size <= int64(cap(n.data)):
+		// Shrinking left the old contents there.
+		n.data = n.data[:size]
+		for i := range n.data[old:] {
+			n.data[old+int64(i)] = 0
+		}
+	default:
+		c := 2 * int64(cap(n.data))
+		if c < size {
+			c = size
+		}
+		data := make([]byte, size, c)
+		copy(data, n.data)
+		n.data = data
+	}
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	return &memInfo{name: filepath.Base(name), size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *memInfo) Name() string       { return fi.name }
+func (fi *memInfo) Size() int64        { return fi.size }
+func (fi *memInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memInfo) Sys() interface{}   { return nil }
+
+type memFile struct {
+	fs     *MemFS
+	node   *memNode
+	name   string
+	flag   int
+	off    int64
+	closed bool
+}
+
+// Must be called with f.fs.mu held.
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	case f.node.dir:
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0, !write && f.flag&os.O_WRONLY != 0:
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EINVAL}
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.node.data))
+	}
+	if end := f.off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.resize(end)
+	}
+	copy(f.node.data[f.off:], p)
+	f.off += int64(len(p))
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.node.resize(size)
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	return f.node.info(f.name), nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,241 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// Runs the same checks on both filesystems, so MemFS behaves like the real one.
+func eachFS(t *testing.T, f func(t *testing.T, fsys FS, root string)) {
+	t.Run("OS", func(t *testing.T) {
+		f(t, OS, t.TempDir())
+	})
+	t.Run("Mem", func(t *testing.T) {
+		fsys := NewMemFS()
+		root := filepath.Join(string(filepath.Separator), "served")
+		if err := fsys.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+		f(t, fsys, root)
+	})
+}
+
+func writeFile(t *testing.T, fsys FS, name string, data string) {
+	t.Helper()
+	f, err := fsys.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilesAndDirectories(t *testing.T) {
+	eachFS(t, func(t *testing.T, fsys FS, root string) {
+		writeFile(t, fsys, filepath.Join(root, "b.xci"), "")
+		writeFile(t, fsys, filepath.Join(root, "a.nsp"), "hello")
+		if err := fsys.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, fsys, filepath.Join(root, "sub", "c.nsp"), "nested")
+
+		files, err := GetFilesIn(fsys, root)
+		if err != nil || !reflect.DeepEqual(files, []string{"a.nsp", "b.xci"}) {
+			t.Fatalf("got files %v. %v", files, err)
+		}
+		dirs, err := GetDirectoriesIn(fsys, root)
+		if err != nil || !reflect.DeepEqual(dirs, []string{"sub"}) {
+			t.Fatalf("got directories %v. %v", dirs, err)
+		}
+
+		fi, err := fsys.Stat(filepath.Join(root, "a.nsp"))
+		if err != nil || fi.IsDir() || fi.Size() != 5 || fi.Name() != "a.nsp" {
+			t.Fatalf("got %v. %v", fi, err)
+		}
+		if fi, err := fsys.Stat(filepath.Join(root, "sub")); err != nil || !fi.IsDir() {
+			t.Fatalf("got %v. %v", fi, err)
+		}
+
+		for _, err := range []error{
+			fsys.Mkdir(filepath.Join(root, "sub"), 0755),
+			fsys.Mkdir(filepath.Join(root, "missing", "dir"), 0755),
+			fsys.Remove(filepath.Join(root, "sub")),
+			fsys.Remove(filepath.Join(root, "missing")),
+		} {
+			if err == nil {
+				t.Fatal("expected a failure")
+			}
+		}
+		if _, err := fsys.Stat(filepath.Join(root, "missing")); !os.IsNotExist(err) {
+			t.Fatalf("got %v, want not exist", err)
+		}
+		if _, err := fsys.ReadDir(filepath.Join(root, "a.nsp")); !errors.Is(err, syscall.ENOTDIR) {
+			t.Fatalf("got %v, want ENOTDIR", err)
+		}
+	})
+}
+
+func TestOpenModes(t *testing.T) {
+	eachFS(t, func(t *testing.T, fsys FS, root string) {
+		name := filepath.Join(root, "dump.bin")
+
+		if _, err := fsys.Open(name); !os.IsNotExist(err) {
+			t.Fatalf("got %v, want not exist", err)
+		}
+		writeFile(t, fsys, name, "0123456789")
+		if _, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+			t.Fatalf("got %v, want exist", err)
+		}
+
+		// Appending keeps the contents, rolling back truncates.
+		f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("abc")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Truncate(12); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("z")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if b, err := ReadFile(fsys, name); err != nil || string(b) != "0123456789abz" {
+			t.Fatalf("got %q. %v", b, err)
+		}
+
+		f, err = fsys.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		b := make([]byte, 5)
+		if n, err := f.ReadAt(b, 10); n != 3 || err != io.EOF || string(b[:n]) != "abz" {
+			t.Fatalf("got %v %q. %v", n, b[:n], err)
+		}
+		if _, err := f.Write([]byte("x")); err == nil {
+			t.Fatal("wrote to a file opened for reading")
+		}
+
+		// Truncating empties it.
+		w, err := fsys.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		if fi, err := fsys.Stat(name); err != nil || fi.Size() != 0 {
+			t.Fatalf("got %v. %v", fi, err)
+		}
+	})
+}
+
+func TestTruncateAndWritePastEnd(t *testing.T) {
+	eachFS(t, func(t *testing.T, fsys FS, root string) {
+		name := filepath.Join(root, "dump.bin")
+		writeFile(t, fsys, name, "0123456789")
+
+		f, err := fsys.OpenFile(name, os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		// Growing back after shrinking, or writing past the end, leaves zeros.
+		if err := f.Truncate(2); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Truncate(5); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("ab")); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ReadFile(fsys, name); err != nil || string(b) != "ab\x00\x00\x00" {
+			t.Fatalf("got %q. %v", b, err)
+		}
+		if err := f.Truncate(1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("cd")); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ReadFile(fsys, name); err != nil || string(b) != "a\x00cd" {
+			t.Fatalf("got %q. %v", b, err)
+		}
+	})
+}
+
+// Writes a 64 MiB file a chunk at a time, like Goldleaf does.
+func BenchmarkMemFSWrite(b *testing.B) {
+	const chunkSize, fileSize = 1 << 20, 64 << 20
+	chunk := make([]byte, chunkSize)
+	name := filepath.Join(string(filepath.Separator), "dump.bin")
+
+	b.SetBytes(fileSize)
+	for i := 0; i < b.N; i++ {
+		f, err := NewMemFS().Create(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for n := 0; n < fileSize; n += chunkSize {
+			if _, err := f.Write(chunk); err != nil {
+				b.Fatal(err)
+			}
+		}
+		f.Close()
+	}
+}
+
+func TestRenameAndRemoveAll(t *testing.T) {
+	eachFS(t, func(t *testing.T, fsys FS, root string) {
+		dir := filepath.Join(root, "games")
+		if err := MkdirAll(fsys, filepath.Join(dir, "a", "b"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := MkdirAll(fsys, filepath.Join(dir, "a"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, fsys, filepath.Join(dir, "a", "b", "c.nsp"), "game")
+
+		moved := filepath.Join(root, "moved")
+		if err := fsys.Rename(dir, moved); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ReadFile(fsys, filepath.Join(moved, "a", "b", "c.nsp")); err != nil || string(b) != "game" {
+			t.Fatalf("got %q. %v", b, err)
+		}
+		if _, err := fsys.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("got %v, want not exist", err)
+		}
+		if err := fsys.Rename(moved, filepath.Join(moved, "a", "inside")); err == nil {
+			t.Fatal("moved a directory inside itself")
+		}
+		if err := fsys.Rename(filepath.Join(root, "missing"), dir); !os.IsNotExist(err) {
+			t.Fatalf("got %v, want not exist", err)
+		}
+
+		if err := RemoveAll(fsys, moved); err != nil {
+			t.Fatal(err)
+		}
+		if err := RemoveAll(fsys, moved); err != nil {
+			t.Fatal(err)
+		}
+		if entries, err := fsys.ReadDir(root); err != nil || len(entries) != 0 {
+			t.Fatalf("got %v. %v", entries, err)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// OS is the local filesystem.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (osFS) Open(name string) (File, error) {
+	return fileOrNil(os.Open(name))
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return fileOrNil(os.OpenFile(name, flag, perm))
+}
+
+func (osFS) Create(name string) (File, error) {
+	return fileOrNil(os.Create(name))
+}
+
+func (osFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldname string, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) EvalSymlinks(name string) (string, error) {
+	return filepath.EvalSymlinks(name)
+}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+// Keeps a nil *os.File from becoming a non nil File.
+func fileOrNil(f *os.File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
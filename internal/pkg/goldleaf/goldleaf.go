@@ -0,0 +1,392 @@
+// Package goldleaf emulates the Goldleaf side of the Quark protocol so
+// goQuark can be exercised without a Switch attached.
+package goldleaf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	blockSize = 0x1000
+	glci      = 0x49434C47
+	glco      = 0x4F434C47
+)
+
+// Command IDs, in the same order Goldleaf defines them.
+const (
+	cmdInvalid uint32 = iota
+	cmdGetDriveCount
+	cmdGetDriveInfo
+	cmdStatPath
+	cmdGetFileCount
+	cmdGetFile
+	cmdGetDirectoryCount
+	cmdGetDirectory
+	cmdStartFile
+	cmdReadFile
+	cmdWriteFile
+	cmdEndFile
+	cmdCreate
+	cmdDelete
+	cmdRename
+	cmdGetSpecialPathCount
+	cmdGetSpecialPath
+	cmdSelectFile
+)
+
+// Values used by StatPath, Create, Delete and Rename.
+const (
+	TypeFile      = 1
+	TypeDirectory = 2
+)
+
+// Values used by StartFile and EndFile.
+const (
+	ModeRead   = 1
+	ModeWrite  = 2
+	ModeAppend = 3
+)
+
+// Returned when goQuark answers with a result other than success.
+type ResultError struct {
+	Code uint32
+}
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("goldleaf: request failed with result 0x%X", e.Code)
+}
+
+// Client speaks to goQuark the way Goldleaf does.
+// It isn't safe for concurrent use.
+type Client struct {
+	r io.ReadCloser
+	w io.WriteCloser
+}
+
+func newClient(r io.ReadCloser, w io.WriteCloser) *Client {
+	return &Client{r: r, w: w}
+}
+
+// Closes the link, goQuark sees it as a disconnection.
+func (c *Client) Close() error {
+	c.w.Close()
+	return c.r.Close()
+}
+
+// Request holds the payload of a command being built.
+type Request struct {
+	id  uint32
+	buf bytes.Buffer
+}
+
+// Starts a request for the given command ID.
+func NewRequest(id uint32) *Request {
+	return &Request{id: id}
+}
+
+func (r *Request) WriteInt32(v uint32) *Request {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	r.buf.Write(b)
+	return r
+}
+
+func (r *Request) WriteInt64(v uint64) *Request {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	r.buf.Write(b)
+	return r
+}
+
+// Writes the length in UTF-16 code units followed by the UTF-16LE string.
+func (r *Request) WriteString(v string) *Request {
+	u := utf16.Encode([]rune(v))
+	r.WriteInt32(uint32(len(u)))
+	for _, c := range u {
+		b := make([]byte, 2)
+		binary.LittleEndian.PutUint16(b, c)
+		r.buf.Write(b)
+	}
+	return r
+}
+
+// Block returns the request as sent over the wire: GLCI magic, command ID
+// and the payload, padded with zeros up to a full block.
+func (r *Request) Block() []byte {
+	b := make([]byte, blockSize)
+	binary.LittleEndian.PutUint32(b[0:], glci)
+	binary.LittleEndian.PutUint32(b[4:], r.id)
+	copy(b[8:], r.buf.Bytes())
+	return b
+}
+
+// Response wraps the block sent back by goQuark.
+type Response struct {
+	Result uint32
+	body   *bytes.Reader
+}
+
+func (r *Response) ReadInt32() (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r.body, b); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (r *Response) ReadInt64() (uint64, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r.body, b); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+func (r *Response) ReadString() (string, error) {
+	n, err := r.ReadInt32()
+	if err != nil {
+		return "", err
+	}
+	u := make([]uint16, n)
+	for i := range u {
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(r.body, b); err != nil {
+			return "", err
+		}
+		u[i] = binary.LittleEndian.Uint16(b)
+	}
+	return string(utf16.Decode(u)), nil
+}
+
+// Sends a raw block to goQuark.
+func (c *Client) WriteRaw(p []byte) error {
+	_, err := c.w.Write(p)
+	return err
+}
+
+// Reads exactly len(p) raw bytes from goQuark.
+func (c *Client) ReadRaw(p []byte) error {
+	_, err := io.ReadFull(c.r, p)
+	return err
+}
+
+// Sends req and waits for its response block.
+// A non-success result is returned as *ResultError alongside the response.
+func (c *Client) Call(req *Request) (*Response, error) {
+	if err := c.WriteRaw(req.Block()); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, blockSize)
+	if err := c.ReadRaw(b); err != nil {
+		return nil, err
+	}
+
+	if m := binary.LittleEndian.Uint32(b[0:]); m != glco {
+		return nil, fmt.Errorf("goldleaf: invalid magic GLCO, got 0x%X", m)
+	}
+
+	res := &Response{
+		Result: binary.LittleEndian.Uint32(b[4:]),
+		body:   bytes.NewReader(b[8:]),
+	}
+	if res.Result != 0 {
+		return res, &ResultError{Code: res.Result}
+	}
+	return res, nil
+}
+
+func (c *Client) GetDriveCount() (int, error) {
+	res, err := c.Call(NewRequest(cmdGetDriveCount))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.ReadInt32()
+	return int(n), err
+}
+
+// Returns the drive's label and its path prefix.
+func (c *Client) GetDriveInfo(idx int) (string, string, error) {
+	res, err := c.Call(NewRequest(cmdGetDriveInfo).WriteInt32(uint32(idx)))
+	if err != nil {
+		return "", "", err
+	}
+	label, err := res.ReadString()
+	if err != nil {
+		return "", "", err
+	}
+	prefix, err := res.ReadString()
+	if err != nil {
+		return "", "", err
+	}
+	// Free and total space, not reported by goQuark.
+	if _, err := res.ReadInt32(); err != nil {
+		return "", "", err
+	}
+	if _, err := res.ReadInt32(); err != nil {
+		return "", "", err
+	}
+	return label, prefix, nil
+}
+
+// Returns the type (TypeFile or TypeDirectory) and size of path.
+func (c *Client) StatPath(path string) (int, int64, error) {
+	res, err := c.Call(NewRequest(cmdStatPath).WriteString(path))
+	if err != nil {
+		return 0, 0, err
+	}
+	t, err := res.ReadInt32()
+	if err != nil {
+		return 0, 0, err
+	}
+	s, err := res.ReadInt64()
+	return int(t), int64(s), err
+}
+
+func (c *Client) GetFileCount(path string) (int, error) {
+	res, err := c.Call(NewRequest(cmdGetFileCount).WriteString(path))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.ReadInt32()
+	return int(n), err
+}
+
+func (c *Client) GetFile(path string, idx int) (string, error) {
+	res, err := c.Call(NewRequest(cmdGetFile).WriteString(path).WriteInt32(uint32(idx)))
+	if err != nil {
+		return "", err
+	}
+	return res.ReadString()
+}
+
+func (c *Client) GetDirectoryCount(path string) (int, error) {
+	res, err := c.Call(NewRequest(cmdGetDirectoryCount).WriteString(path))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.ReadInt32()
+	return int(n), err
+}
+
+func (c *Client) GetDirectory(path string, idx int) (string, error) {
+	res, err := c.Call(NewRequest(cmdGetDirectory).WriteString(path).WriteInt32(uint32(idx)))
+	if err != nil {
+		return "", err
+	}
+	return res.ReadString()
+}
+
+func (c *Client) StartFile(path string, mode int) error {
+	_, err := c.Call(NewRequest(cmdStartFile).WriteString(path).WriteInt32(uint32(mode)))
+	return err
+}
+
+// Reads up to size bytes of path starting at offset.
+func (c *Client) ReadFile(path string, offset int64, size int64) ([]byte, error) {
+	b := make([]byte, size)
+	n, err := c.ReadFileInto(path, offset, b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// Like ReadFile, but reads into p and returns how many bytes were sent.
+func (c *Client) ReadFileInto(path string, offset int64, p []byte) (int, error) {
+	req := NewRequest(cmdReadFile).WriteString(path).WriteInt64(uint64(offset)).WriteInt64(uint64(len(p)))
+	res, err := c.Call(req)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.ReadInt64()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(p)) {
+		return 0, fmt.Errorf("goldleaf: asked for %v bytes, got %v", len(p), n)
+	}
+
+	// File contents are sent right after the response block.
+	if err := c.ReadRaw(p[:n]); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (c *Client) WriteFile(path string, data []byte) error {
+	req := NewRequest(cmdWriteFile).WriteString(path).WriteInt64(uint64(len(data)))
+	if err := c.WriteRaw(req.Block()); err != nil {
+		return err
+	}
+
+	// File contents are sent right after the request block.
+	if err := c.WriteRaw(data); err != nil {
+		return err
+	}
+
+	b := make([]byte, blockSize)
+	if err := c.ReadRaw(b); err != nil {
+		return err
+	}
+	if r := binary.LittleEndian.Uint32(b[4:]); r != 0 {
+		return &ResultError{Code: r}
+	}
+	return nil
+}
+
+func (c *Client) EndFile(mode int) error {
+	_, err := c.Call(NewRequest(cmdEndFile).WriteInt32(uint32(mode)))
+	return err
+}
+
+func (c *Client) Create(fType int, path string) error {
+	_, err := c.Call(NewRequest(cmdCreate).WriteInt32(uint32(fType)).WriteString(path))
+	return err
+}
+
+func (c *Client) Delete(fType int, path string) error {
+	_, err := c.Call(NewRequest(cmdDelete).WriteInt32(uint32(fType)).WriteString(path))
+	return err
+}
+
+func (c *Client) Rename(fType int, path string, newPath string) error {
+	req := NewRequest(cmdRename).WriteInt32(uint32(fType)).WriteString(path).WriteString(newPath)
+	_, err := c.Call(req)
+	return err
+}
+
+func (c *Client) GetSpecialPathCount() (int, error) {
+	res, err := c.Call(NewRequest(cmdGetSpecialPathCount))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.ReadInt32()
+	return int(n), err
+}
+
+// Returns the alias and the path of the special path at idx.
+func (c *Client) GetSpecialPath(idx int) (string, string, error) {
+	res, err := c.Call(NewRequest(cmdGetSpecialPath).WriteInt32(uint32(idx)))
+	if err != nil {
+		return "", "", err
+	}
+	name, err := res.ReadString()
+	if err != nil {
+		return "", "", err
+	}
+	path, err := res.ReadString()
+	return name, path, err
+}
+
+func (c *Client) SelectFile() (string, error) {
+	res, err := c.Call(NewRequest(cmdSelectFile))
+	if err != nil {
+		return "", err
+	}
+	return res.ReadString()
+}
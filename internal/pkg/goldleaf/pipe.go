@@ -0,0 +1,73 @@
+package goldleaf
+
+import (
+	"io"
+	"sync"
+)
+
+// Loopback is the goQuark side of an in-memory link to a Client.
+// It satisfies usb.Transport.
+type Loopback struct {
+	desc   string
+	serial string
+
+	r *io.PipeReader
+	w *io.PipeWriter
+
+	mu        sync.Mutex
+	connected bool
+	closed    bool
+}
+
+// Creates an in-memory link. The returned Loopback is meant to be handed to
+// goQuark as its transport, the Client talks to it as Goldleaf would.
+func Pipe(desc string, serial string) (*Loopback, *Client) {
+	// Client -> goQuark
+	inR, inW := io.Pipe()
+	// goQuark -> Client
+	outR, outW := io.Pipe()
+
+	l := &Loopback{
+		desc:   desc,
+		serial: serial,
+		r:      inR,
+		w:      outW,
+	}
+	return l, newClient(outR, inW)
+}
+
+// Only one client is served per Loopback.
+// Returns true the first time and false once the link was closed.
+func (l *Loopback) Connect() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.connected || l.closed {
+		return false
+	}
+	l.connected = true
+	return true
+}
+
+func (l *Loopback) Read(p []byte) (int, error) {
+	return io.ReadFull(l.r, p)
+}
+
+func (l *Loopback) Write(p []byte) (int, error) {
+	return l.w.Write(p)
+}
+
+func (l *Loopback) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.r.Close()
+	l.w.Close()
+}
+
+func (l *Loopback) Description() (string, error) {
+	return l.desc, nil
+}
+
+func (l *Loopback) SerialNumber() (string, error) {
+	return l.serial, nil
+}
@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+)
+
+// Encoder lays out values the way Goldleaf reads them, little endian.
+type Encoder struct {
+	buf bytes.Buffer
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+func (e *Encoder) Uint32(v uint32) {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	e.buf.Write(b)
+}
+
+func (e *Encoder) Uint64(v uint64) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	e.buf.Write(b)
+}
+
+// Writes the number of UTF-16 code units of v followed by v in UTF-16.
+// Characters outside the BMP take a surrogate pair, so two code units.
+func (e *Encoder) String(v string) {
+	units := utf16.Encode([]rune(v))
+	e.Uint32(uint32(len(units)))
+
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+	e.buf.Write(b)
+}
+
+// Appends p as is.
+func (e *Encoder) Write(p []byte) {
+	e.buf.Write(p)
+}
+
+func (e *Encoder) Bytes() []byte {
+	return e.buf.Bytes()
+}
+
+func (e *Encoder) Len() int {
+	return e.buf.Len()
+}
+
+// Pads the encoded bytes up to a whole block.
+func (e *Encoder) block() ([]byte, error) {
+	if e.buf.Len() > BlockSize {
+		return nil, fmt.Errorf("%w: %v bytes", ErrBlockOverflow, e.buf.Len())
+	}
+	e.buf.Write(make([]byte, BlockSize-e.buf.Len()))
+	return e.buf.Bytes(), nil
+}
+
+// Decoder reads values in the order they were encoded.
+type Decoder struct {
+	b   []byte
+	off int
+}
+
+func NewDecoder(b []byte) *Decoder {
+	return &Decoder{b: b}
+}
+
+// Returns the next n bytes, failing unless there are that many left.
+// Nothing is consumed on failure.
+func (d *Decoder) next(n int, what string) ([]byte, error) {
+	if n < 0 || n > len(d.b)-d.off {
+		return nil, fmt.Errorf("%w: %v needs %v bytes, %v left", ErrMalformed, what, n, len(d.b)-d.off)
+	}
+	p := d.b[d.off : d.off+n]
+	d.off += n
+	return p, nil
+}
+
+func (d *Decoder) Uint32() (uint32, error) {
+	p, err := d.next(4, "uint32")
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(p), nil
+}
+
+func (d *Decoder) Uint64() (uint64, error) {
+	p, err := d.next(8, "uint64")
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(p), nil
+}
+
+func (d *Decoder) Int64() (int64, error) {
+	v, err := d.Uint64()
+	return int64(v), err
+}
+
+// Reads a number of UTF-16 code units followed by them.
+// Unpaired surrogates are replaced by U+FFFD.
+func (d *Decoder) String() (string, error) {
+	start := d.off
+	size, err := d.Uint32()
+	if err != nil {
+		return "", err
+	}
+
+	// Checked before doubling it, so it can't overflow an int.
+	if left := len(d.b) - d.off; int64(size)*2 > int64(left) {
+		d.off = start
+		return "", fmt.Errorf("%w: string of %v code units, %v bytes left", ErrMalformed, size, left)
+	}
+	p, err := d.next(int(size)*2, "string")
+	if err != nil {
+		return "", err
+	}
+
+	units := make([]uint16, len(p)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(p[2*i:])
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// Returns what's left to decode.
+func (d *Decoder) Remaining() []byte {
+	return d.b[d.off:]
+}
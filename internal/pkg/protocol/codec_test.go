@@ -0,0 +1,228 @@
+package protocol
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+func roundTrip(s string) (string, error) {
+	e := NewEncoder()
+	e.String(s)
+	return NewDecoder(e.Bytes()).String()
+}
+
+func TestStringCodeUnits(t *testing.T) {
+	tests := []struct {
+		s     string
+		units uint32
+	}{
+		{"", 0},
+		{"Home:/", 6},
+		{"Pokémon", 7},
+		{"ゼルダの伝説", 6},
+		{"🎮", 2},
+		{"a🎮b𝄞", 6},
+	}
+	for _, tt := range tests {
+		e := NewEncoder()
+		e.String(tt.s)
+
+		d := NewDecoder(e.Bytes())
+		n, _ := d.Uint32()
+		if n != tt.units {
+			t.Errorf("%q: got %v code units, want %v", tt.s, n, tt.units)
+		}
+		if len(e.Bytes()) != 4+2*int(tt.units) {
+			t.Errorf("%q: got %v bytes, want %v", tt.s, len(e.Bytes()), 4+2*tt.units)
+		}
+
+		got, err := roundTrip(tt.s)
+		if err != nil || got != tt.s {
+			t.Errorf("got %q, %v, want %q", got, err, tt.s)
+		}
+	}
+}
+
+func TestStringSurrogatePair(t *testing.T) {
+	e := NewEncoder()
+	e.String("🎮")
+	// U+1F3AE as D83C DFAE.
+	want := []byte{2, 0, 0, 0, 0x3C, 0xD8, 0xAE, 0xDF}
+	if !reflect.DeepEqual(e.Bytes(), want) {
+		t.Fatalf("got % X, want % X", e.Bytes(), want)
+	}
+}
+
+func TestStringUnpairedSurrogate(t *testing.T) {
+	// A lone high surrogate followed by 'a'.
+	d := NewDecoder([]byte{2, 0, 0, 0, 0x3C, 0xD8, 'a', 0})
+	s, err := d.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "�a" {
+		t.Fatalf("got %q", s)
+	}
+}
+
+func TestStringLongerThanBlock(t *testing.T) {
+	s := strings.Repeat("長い名前", BlockSize)
+	e := NewEncoder()
+	e.String(s)
+	if e.Len() <= BlockSize {
+		t.Fatalf("got %v bytes, want more than a block", e.Len())
+	}
+
+	got, err := NewDecoder(e.Bytes()).String()
+	if err != nil || got != s {
+		t.Fatalf("long string didn't round trip, %v", err)
+	}
+}
+
+// Characters from a given script, astral ones included.
+var scripts = map[string][][2]rune{
+	"ascii":    {{0x20, 0x7E}},
+	"latin":    {{0xC0, 0x24F}},
+	"greek":    {{0x370, 0x3FF}},
+	"cyrillic": {{0x400, 0x4FF}},
+	"arabic":   {{0x600, 0x6FF}},
+	"cjk":      {{0x3040, 0x30FF}, {0x4E00, 0x9FFF}, {0xAC00, 0xD7A3}},
+	"emoji":    {{0x1F300, 0x1F6FF}, {0x1F900, 0x1F9FF}},
+	"astral":   {{0x10000, 0x10FFFF}},
+	"mixed":    {{0x20, 0x7E}, {0x4E00, 0x9FFF}, {0x1F300, 0x1F6FF}, {0xE000, 0xFFFD}},
+}
+
+func randomString(r *rand.Rand, ranges [][2]rune) string {
+	var b strings.Builder
+	for i := r.Intn(300); i > 0; i-- {
+		rg := ranges[r.Intn(len(ranges))]
+		c := rg[0] + rune(r.Intn(int(rg[1]-rg[0]+1)))
+		if !utf8.ValidRune(c) {
+			c = utf8.RuneError
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func TestStringProperties(t *testing.T) {
+	for name, ranges := range scripts {
+		ranges := ranges
+		cfg := &quick.Config{
+			MaxCount: 500,
+			Values: func(v []reflect.Value, r *rand.Rand) {
+				v[0] = reflect.ValueOf(randomString(r, ranges))
+			},
+		}
+
+		// Strings survive a round trip.
+		if err := quick.Check(func(s string) bool {
+			got, err := roundTrip(s)
+			return err == nil && got == s
+		}, cfg); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+
+		// The length sent is the number of UTF-16 code units, never the UTF-8 length.
+		if err := quick.Check(func(s string) bool {
+			e := NewEncoder()
+			e.String(s)
+			n, _ := NewDecoder(e.Bytes()).Uint32()
+			return int(n) == len(utf16.Encode([]rune(s))) && e.Len() == 4+2*int(n)
+		}, cfg); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+
+		// Strings don't eat into what follows them.
+		if err := quick.Check(func(s string) bool {
+			e := NewEncoder()
+			e.String(s)
+			e.Uint32(0xC0FFEE)
+			d := NewDecoder(e.Bytes())
+			if _, err := d.String(); err != nil {
+				return false
+			}
+			v, err := d.Uint32()
+			return err == nil && v == 0xC0FFEE
+		}, cfg); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+}
+
+func TestArbitraryStrings(t *testing.T) {
+	// Invalid UTF-8 is sent as U+FFFD, anything else as is.
+	if err := quick.Check(func(s string) bool {
+		got, err := roundTrip(s)
+		return err == nil && got == string([]rune(s))
+	}, nil); err != nil {
+		t.Error(err)
+	}
+	if got, _ := roundTrip("a\xffb"); got != "a�b" {
+		t.Errorf("got %q", got)
+	}
+	if err := quick.Check(func(b []byte) bool {
+		got, err := roundTrip(string(b))
+		return err == nil && got == string([]rune(string(b)))
+	}, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecoderBounds(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		read func(d *Decoder) error
+	}{
+		{"short uint32", []byte{1, 2, 3}, func(d *Decoder) error { _, err := d.Uint32(); return err }},
+		{"short uint64", []byte{1, 2, 3, 4, 5, 6, 7}, func(d *Decoder) error { _, err := d.Uint64(); return err }},
+		{"no string length", []byte{1}, func(d *Decoder) error { _, err := d.String(); return err }},
+		{"string past the end", []byte{3, 0, 0, 0, 'a', 0, 'b', 0}, func(d *Decoder) error { _, err := d.String(); return err }},
+		{"huge string", []byte{0xFF, 0xFF, 0xFF, 0xFF, 'a', 0}, func(d *Decoder) error { _, err := d.String(); return err }},
+		{"negative looking string", []byte{0, 0, 0, 0x80, 'a', 0}, func(d *Decoder) error { _, err := d.String(); return err }},
+	}
+	for _, tt := range tests {
+		d := NewDecoder(tt.b)
+		if err := tt.read(d); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%v: got %v, want malformed", tt.name, err)
+		}
+	}
+
+	// Failed reads of a value don't consume it.
+	d := NewDecoder([]byte{1, 0, 0, 0})
+	if _, err := d.Uint64(); err == nil {
+		t.Fatal("read 8 bytes out of 4")
+	}
+	if v, err := d.Uint32(); err != nil || v != 1 {
+		t.Fatalf("got %v, %v", v, err)
+	}
+}
+
+func TestWriteFileSize(t *testing.T) {
+	for _, size := range []int64{-1, MaxWriteSize + 1} {
+		block, err := MarshalRequest(WriteFile, &WriteFileRequest{Path: "Home:/a", Size: size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, d, err := UnmarshalRequest(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m WriteFileRequest
+		err = m.Decode(d)
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("size %v: got %v, want malformed", size, err)
+		}
+		// Only sizes that can be skipped are told apart.
+		if errors.Is(err, ErrWriteTooLarge) != (size > 0) || m.Size != size {
+			t.Errorf("size %v: got %v with size %v", size, err, m.Size)
+		}
+	}
+}
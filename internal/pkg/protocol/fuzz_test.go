@@ -0,0 +1,105 @@
+//go:build go1.18
+// +build go1.18
+
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Decodes arbitrary bytes as a sequence of values, picked by ops.
+func FuzzDecoder(f *testing.F) {
+	e := NewEncoder()
+	e.String("Home:/ゲーム🎮")
+	e.Uint32(7)
+	e.Uint64(1 << 40)
+	f.Add(e.Bytes(), []byte{2, 0, 1})
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF}, []byte{2})
+	f.Add([]byte{}, []byte{0, 1, 2})
+
+	f.Fuzz(func(t *testing.T, b []byte, ops []byte) {
+		d := NewDecoder(b)
+		for _, op := range ops {
+			before := len(d.Remaining())
+			var err error
+			switch op % 3 {
+			case 0:
+				_, err = d.Uint32()
+			case 1:
+				_, err = d.Uint64()
+			case 2:
+				_, err = d.String()
+			}
+			left := len(d.Remaining())
+			if err != nil && left != before {
+				t.Fatalf("failed read consumed %v bytes", before-left)
+			}
+			if left > before {
+				t.Fatalf("remaining grew from %v to %v", before, left)
+			}
+		}
+	})
+}
+
+// Decodes arbitrary blocks as requests of every command. Whatever decodes
+// must encode back to a request decoding the same.
+func FuzzRequests(f *testing.F) {
+	for _, c := range commands {
+		block, err := MarshalRequest(c.id, c.req)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(block)
+	}
+	f.Add([]byte("GLCI"))
+
+	f.Fuzz(func(t *testing.T, block []byte) {
+		id, d, err := UnmarshalRequest(block)
+		if err != nil {
+			return
+		}
+		payload := d.Remaining()
+
+		for _, c := range commands {
+			m := c.newReq()
+			if err := m.Decode(NewDecoder(payload)); err != nil {
+				continue
+			}
+
+			again, err := MarshalRequest(id, m)
+			if err != nil {
+				t.Fatalf("%v: decoded %+v doesn't encode back. %v", c.id, m, err)
+			}
+			_, d, err := UnmarshalRequest(again)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := c.newReq()
+			if err := got.Decode(d); err != nil {
+				t.Fatalf("%v: %v", c.id, err)
+			}
+			if !reflect.DeepEqual(got, m) {
+				t.Fatalf("%v: got %+v, want %+v", c.id, got, m)
+			}
+		}
+	})
+}
+
+// Decodes arbitrary blocks as responses of every command.
+func FuzzResponses(f *testing.F) {
+	for _, c := range commands {
+		block, err := MarshalResponse(c.resp)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(block)
+	}
+	f.Add(MarshalFailure(0xCA64))
+
+	f.Fuzz(func(t *testing.T, block []byte) {
+		for _, c := range commands {
+			UnmarshalResponse(block, c.newResp())
+		}
+	})
+}
@@ -0,0 +1,470 @@
+package protocol
+
+import "fmt"
+
+// Requests and responses of every command. Commands without payload or
+// without response have an empty struct, so every command reads the same.
+
+type GetDriveCountRequest struct{}
+
+func (m *GetDriveCountRequest) Encode(e *Encoder)       {}
+func (m *GetDriveCountRequest) Decode(d *Decoder) error { return nil }
+
+type GetDriveCountResponse struct {
+	Count uint32
+}
+
+func (m *GetDriveCountResponse) Encode(e *Encoder) {
+	e.Uint32(m.Count)
+}
+
+func (m *GetDriveCountResponse) Decode(d *Decoder) (err error) {
+	m.Count, err = d.Uint32()
+	return err
+}
+
+type GetDriveInfoRequest struct {
+	Index uint32
+}
+
+func (m *GetDriveInfoRequest) Encode(e *Encoder) {
+	e.Uint32(m.Index)
+}
+
+func (m *GetDriveInfoRequest) Decode(d *Decoder) (err error) {
+	m.Index, err = d.Uint32()
+	return err
+}
+
+type GetDriveInfoResponse struct {
+	Label string
+	// Drive as Goldleaf refers to it, like "C:".
+	Prefix     string
+	FreeSpace  uint32
+	TotalSpace uint32
+}
+
+func (m *GetDriveInfoResponse) Encode(e *Encoder) {
+	e.String(m.Label)
+	e.String(m.Prefix)
+	e.Uint32(m.FreeSpace)
+	e.Uint32(m.TotalSpace)
+}
+
+func (m *GetDriveInfoResponse) Decode(d *Decoder) (err error) {
+	if m.Label, err = d.String(); err != nil {
+		return err
+	}
+	if m.Prefix, err = d.String(); err != nil {
+		return err
+	}
+	if m.FreeSpace, err = d.Uint32(); err != nil {
+		return err
+	}
+	m.TotalSpace, err = d.Uint32()
+	return err
+}
+
+type StatPathRequest struct {
+	Path string
+}
+
+func (m *StatPathRequest) Encode(e *Encoder) {
+	e.String(m.Path)
+}
+
+func (m *StatPathRequest) Decode(d *Decoder) (err error) {
+	m.Path, err = d.String()
+	return err
+}
+
+type StatPathResponse struct {
+	// TypeFile or TypeDirectory.
+	Type uint32
+	// Always 0 for directories.
+	Size uint64
+}
+
+func (m *StatPathResponse) Encode(e *Encoder) {
+	e.Uint32(m.Type)
+	e.Uint64(m.Size)
+}
+
+func (m *StatPathResponse) Decode(d *Decoder) (err error) {
+	if m.Type, err = d.Uint32(); err != nil {
+		return err
+	}
+	m.Size, err = d.Uint64()
+	return err
+}
+
+type GetFileCountRequest struct {
+	Path string
+}
+
+func (m *GetFileCountRequest) Encode(e *Encoder) {
+	e.String(m.Path)
+}
+
+func (m *GetFileCountRequest) Decode(d *Decoder) (err error) {
+	m.Path, err = d.String()
+	return err
+}
+
+type GetFileCountResponse struct {
+	Count uint32
+}
+
+func (m *GetFileCountResponse) Encode(e *Encoder) {
+	e.Uint32(m.Count)
+}
+
+func (m *GetFileCountResponse) Decode(d *Decoder) (err error) {
+	m.Count, err = d.Uint32()
+	return err
+}
+
+type GetFileRequest struct {
+	Path  string
+	Index uint32
+}
+
+func (m *GetFileRequest) Encode(e *Encoder) {
+	e.String(m.Path)
+	e.Uint32(m.Index)
+}
+
+func (m *GetFileRequest) Decode(d *Decoder) (err error) {
+	if m.Path, err = d.String(); err != nil {
+		return err
+	}
+	m.Index, err = d.Uint32()
+	return err
+}
+
+type GetFileResponse struct {
+	Name string
+}
+
+func (m *GetFileResponse) Encode(e *Encoder) {
+	e.String(m.Name)
+}
+
+func (m *GetFileResponse) Decode(d *Decoder) (err error) {
+	m.Name, err = d.String()
+	return err
+}
+
+type GetDirectoryCountRequest struct {
+	Path string
+}
+
+func (m *GetDirectoryCountRequest) Encode(e *Encoder) {
+	e.String(m.Path)
+}
+
+func (m *GetDirectoryCountRequest) Decode(d *Decoder) (err error) {
+	m.Path, err = d.String()
+	return err
+}
+
+type GetDirectoryCountResponse struct {
+	Count uint32
+}
+
+func (m *GetDirectoryCountResponse) Encode(e *Encoder) {
+	e.Uint32(m.Count)
+}
+
+func (m *GetDirectoryCountResponse) Decode(d *Decoder) (err error) {
+	m.Count, err = d.Uint32()
+	return err
+}
+
+type GetDirectoryRequest struct {
+	Path  string
+	Index uint32
+}
+
+func (m *GetDirectoryRequest) Encode(e *Encoder) {
+	e.String(m.Path)
+	e.Uint32(m.Index)
+}
+
+func (m *GetDirectoryRequest) Decode(d *Decoder) (err error) {
+	if m.Path, err = d.String(); err != nil {
+		return err
+	}
+	m.Index, err = d.Uint32()
+	return err
+}
+
+type GetDirectoryResponse struct {
+	Name string
+}
+
+func (m *GetDirectoryResponse) Encode(e *Encoder) {
+	e.String(m.Name)
+}
+
+func (m *GetDirectoryResponse) Decode(d *Decoder) (err error) {
+	m.Name, err = d.String()
+	return err
+}
+
+type StartFileRequest struct {
+	Path string
+	// ModeRead, ModeWrite or ModeAppend.
+	Mode uint32
+}
+
+func (m *StartFileRequest) Encode(e *Encoder) {
+	e.String(m.Path)
+	e.Uint32(m.Mode)
+}
+
+func (m *StartFileRequest) Decode(d *Decoder) (err error) {
+	if m.Path, err = d.String(); err != nil {
+		return err
+	}
+	m.Mode, err = d.Uint32()
+	return err
+}
+
+type StartFileResponse struct{}
+
+func (m *StartFileResponse) Encode(e *Encoder)       {}
+func (m *StartFileResponse) Decode(d *Decoder) error { return nil }
+
+type ReadFileRequest struct {
+	Path   string
+	Offset int64
+	Size   int64
+}
+
+func (m *ReadFileRequest) Encode(e *Encoder) {
+	e.String(m.Path)
+	e.Uint64(uint64(m.Offset))
+	e.Uint64(uint64(m.Size))
+}
+
+func (m *ReadFileRequest) Decode(d *Decoder) (err error) {
+	if m.Path, err = d.String(); err != nil {
+		return err
+	}
+	if m.Offset, err = d.Int64(); err != nil {
+		return err
+	}
+	m.Size, err = d.Int64()
+	return err
+}
+
+// Followed by Size raw bytes, sent after the response block.
+type ReadFileResponse struct {
+	Size int64
+}
+
+func (m *ReadFileResponse) Encode(e *Encoder) {
+	e.Uint64(uint64(m.Size))
+}
+
+func (m *ReadFileResponse) Decode(d *Decoder) (err error) {
+	m.Size, err = d.Int64()
+	return err
+}
+
+// Followed by Size raw bytes, sent after the request block.
+type WriteFileRequest struct {
+	Path string
+	Size int64
+}
+
+func (m *WriteFileRequest) Encode(e *Encoder) {
+	e.String(m.Path)
+	e.Uint64(uint64(m.Size))
+}
+
+func (m *WriteFileRequest) Decode(d *Decoder) (err error) {
+	if m.Path, err = d.String(); err != nil {
+		return err
+	}
+	if m.Size, err = d.Int64(); err != nil {
+		return err
+	}
+	// The data is read into memory, so its size can't be trusted.
+	if m.Size < 0 {
+		return fmt.Errorf("%w: WriteFile of %v bytes", ErrMalformed, m.Size)
+	}
+	if m.Size > MaxWriteSize {
+		return fmt.Errorf("%w: %v bytes, at most %v", ErrWriteTooLarge, m.Size, MaxWriteSize)
+	}
+	return nil
+}
+
+type WriteFileResponse struct{}
+
+func (m *WriteFileResponse) Encode(e *Encoder)       {}
+func (m *WriteFileResponse) Decode(d *Decoder) error { return nil }
+
+type EndFileRequest struct {
+	// ModeRead closes files being read, anything else files being written.
+	Mode uint32
+}
+
+func (m *EndFileRequest) Encode(e *Encoder) {
+	e.Uint32(m.Mode)
+}
+
+func (m *EndFileRequest) Decode(d *Decoder) (err error) {
+	m.Mode, err = d.Uint32()
+	return err
+}
+
+type EndFileResponse struct{}
+
+func (m *EndFileResponse) Encode(e *Encoder)       {}
+func (m *EndFileResponse) Decode(d *Decoder) error { return nil }
+
+type CreateRequest struct {
+	// TypeFile or TypeDirectory.
+	Type uint32
+	Path string
+}
+
+func (m *CreateRequest) Encode(e *Encoder) {
+	e.Uint32(m.Type)
+	e.String(m.Path)
+}
+
+func (m *CreateRequest) Decode(d *Decoder) (err error) {
+	if m.Type, err = d.Uint32(); err != nil {
+		return err
+	}
+	m.Path, err = d.String()
+	return err
+}
+
+type CreateResponse struct{}
+
+func (m *CreateResponse) Encode(e *Encoder)       {}
+func (m *CreateResponse) Decode(d *Decoder) error { return nil }
+
+type DeleteRequest struct {
+	// TypeFile or TypeDirectory.
+	Type uint32
+	Path string
+}
+
+func (m *DeleteRequest) Encode(e *Encoder) {
+	e.Uint32(m.Type)
+	e.String(m.Path)
+}
+
+func (m *DeleteRequest) Decode(d *Decoder) (err error) {
+	if m.Type, err = d.Uint32(); err != nil {
+		return err
+	}
+	m.Path, err = d.String()
+	return err
+}
+
+type DeleteResponse struct{}
+
+func (m *DeleteResponse) Encode(e *Encoder)       {}
+func (m *DeleteResponse) Decode(d *Decoder) error { return nil }
+
+type RenameRequest struct {
+	// TypeFile or TypeDirectory.
+	Type    uint32
+	Path    string
+	NewPath string
+}
+
+func (m *RenameRequest) Encode(e *Encoder) {
+	e.Uint32(m.Type)
+	e.String(m.Path)
+	e.String(m.NewPath)
+}
+
+func (m *RenameRequest) Decode(d *Decoder) (err error) {
+	if m.Type, err = d.Uint32(); err != nil {
+		return err
+	}
+	if m.Path, err = d.String(); err != nil {
+		return err
+	}
+	m.NewPath, err = d.String()
+	return err
+}
+
+type RenameResponse struct{}
+
+func (m *RenameResponse) Encode(e *Encoder)       {}
+func (m *RenameResponse) Decode(d *Decoder) error { return nil }
+
+type GetSpecialPathCountRequest struct{}
+
+func (m *GetSpecialPathCountRequest) Encode(e *Encoder)       {}
+func (m *GetSpecialPathCountRequest) Decode(d *Decoder) error { return nil }
+
+type GetSpecialPathCountResponse struct {
+	Count uint32
+}
+
+func (m *GetSpecialPathCountResponse) Encode(e *Encoder) {
+	e.Uint32(m.Count)
+}
+
+func (m *GetSpecialPathCountResponse) Decode(d *Decoder) (err error) {
+	m.Count, err = d.Uint32()
+	return err
+}
+
+type GetSpecialPathRequest struct {
+	Index uint32
+}
+
+func (m *GetSpecialPathRequest) Encode(e *Encoder) {
+	e.Uint32(m.Index)
+}
+
+func (m *GetSpecialPathRequest) Decode(d *Decoder) (err error) {
+	m.Index, err = d.Uint32()
+	return err
+}
+
+type GetSpecialPathResponse struct {
+	Name string
+	Path string
+}
+
+func (m *GetSpecialPathResponse) Encode(e *Encoder) {
+	e.String(m.Name)
+	e.String(m.Path)
+}
+
+func (m *GetSpecialPathResponse) Decode(d *Decoder) (err error) {
+	if m.Name, err = d.String(); err != nil {
+		return err
+	}
+	m.Path, err = d.String()
+	return err
+}
+
+type SelectFileRequest struct{}
+
+func (m *SelectFileRequest) Encode(e *Encoder)       {}
+func (m *SelectFileRequest) Decode(d *Decoder) error { return nil }
+
+type SelectFileResponse struct {
+	Path string
+}
+
+func (m *SelectFileResponse) Encode(e *Encoder) {
+	e.String(m.Path)
+}
+
+func (m *SelectFileResponse) Decode(d *Decoder) (err error) {
+	m.Path, err = d.String()
+	return err
+}
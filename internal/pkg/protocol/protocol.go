@@ -0,0 +1,174 @@
+// Package protocol describes the messages goQuark and Goldleaf exchange
+// over USB and how they're laid out in GLCI/GLCO blocks.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Every request and response is sent as a single block.
+const (
+	BlockSize = 0x1000
+	// Magic starting every request block, "GLCI".
+	GLCI = 0x49434C47
+	// Magic starting every response block, "GLCO".
+	GLCO = 0x4F434C47
+)
+
+// ID identifies a command.
+type ID uint32
+
+// Commands, in the same order Goldleaf defines them.
+const (
+	Invalid ID = iota
+	GetDriveCount
+	GetDriveInfo
+	StatPath
+	GetFileCount
+	GetFile
+	GetDirectoryCount
+	GetDirectory
+	StartFile
+	ReadFile
+	WriteFile
+	EndFile
+	Create
+	Delete
+	Rename
+	GetSpecialPathCount
+	GetSpecialPath
+	SelectFile
+)
+
+var names = []string{
+	"Invalid",
+	"GetDriveCount",
+	"GetDriveInfo",
+	"StatPath",
+	"GetFileCount",
+	"GetFile",
+	"GetDirectoryCount",
+	"GetDirectory",
+	"StartFile",
+	"ReadFile",
+	"WriteFile",
+	"EndFile",
+	"Create",
+	"Delete",
+	"Rename",
+	"GetSpecialPathCount",
+	"GetSpecialPath",
+	"SelectFile",
+}
+
+func (id ID) String() string {
+	if int(id) < len(names) {
+		return names[id]
+	}
+	return fmt.Sprintf("ID(%d)", uint32(id))
+}
+
+// Values used by StatPath, Create, Delete and Rename.
+const (
+	TypeFile      = 1
+	TypeDirectory = 2
+)
+
+// Values used by StartFile and EndFile.
+const (
+	ModeRead   = 1
+	ModeWrite  = 2
+	ModeAppend = 3
+)
+
+// Message is the payload of a request or a response, encoded right after
+// the block header in the order its fields are declared.
+type Message interface {
+	Encode(e *Encoder)
+	Decode(d *Decoder) error
+}
+
+// Largest chunk a single WriteFile may carry, anything beyond it is malformed.
+const MaxWriteSize = 64 << 20
+
+var (
+	ErrInvalidMagic  = errors.New("invalid magic")
+	ErrBlockOverflow = errors.New("message doesn't fit in a block")
+	// Payload that can't be decoded, like a length past the end of the block.
+	ErrMalformed = errors.New("malformed payload")
+	// WriteFile carrying more than MaxWriteSize. Its data can still be skipped.
+	ErrWriteTooLarge = fmt.Errorf("%w: WriteFile too large", ErrMalformed)
+)
+
+// Returns the block Goldleaf sends to run command id with payload m.
+// m may be nil for commands without payload.
+func MarshalRequest(id ID, m Message) ([]byte, error) {
+	e := NewEncoder()
+	e.Uint32(GLCI)
+	e.Uint32(uint32(id))
+	if m != nil {
+		m.Encode(e)
+	}
+	return e.block()
+}
+
+// Checks the magic of a request block, returning its command ID and
+// a Decoder positioned at its payload.
+func UnmarshalRequest(block []byte) (ID, *Decoder, error) {
+	d := NewDecoder(block)
+	magic, err := d.Uint32()
+	if err != nil {
+		return 0, nil, err
+	}
+	if magic != GLCI {
+		return 0, nil, fmt.Errorf("%w: GLCI, got 0x%X", ErrInvalidMagic, magic)
+	}
+	id, err := d.Uint32()
+	if err != nil {
+		return 0, nil, err
+	}
+	return ID(id), d, nil
+}
+
+// Returns the block answering a request successfully with m.
+// m may be nil for commands without response.
+func MarshalResponse(m Message) ([]byte, error) {
+	e := NewEncoder()
+	e.Uint32(GLCO)
+	e.Uint32(0)
+	if m != nil {
+		m.Encode(e)
+	}
+	return e.block()
+}
+
+// Returns the block telling Goldleaf a request failed with result.
+func MarshalFailure(result uint32) []byte {
+	e := NewEncoder()
+	e.Uint32(GLCO)
+	e.Uint32(result)
+	b, _ := e.block()
+	return b
+}
+
+// Checks the magic of a response block and returns its result.
+// m is only decoded when the result is success, it may be nil.
+func UnmarshalResponse(block []byte, m Message) (uint32, error) {
+	d := NewDecoder(block)
+	magic, err := d.Uint32()
+	if err != nil {
+		return 0, err
+	}
+	if magic != GLCO {
+		return 0, fmt.Errorf("%w: GLCO, got 0x%X", ErrInvalidMagic, magic)
+	}
+	result, err := d.Uint32()
+	if err != nil {
+		return 0, err
+	}
+	if result != 0 || m == nil {
+		return result, nil
+	}
+	return result, m.Decode(d)
+}
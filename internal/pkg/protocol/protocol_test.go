@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var commands = []struct {
+	id      ID
+	req     Message
+	newReq  func() Message
+	resp    Message
+	newResp func() Message
+}{
+	{GetDriveCount,
+		&GetDriveCountRequest{}, func() Message { return &GetDriveCountRequest{} },
+		&GetDriveCountResponse{Count: 3}, func() Message { return &GetDriveCountResponse{} }},
+	{GetDriveInfo,
+		&GetDriveInfoRequest{Index: 1}, func() Message { return &GetDriveInfoRequest{} },
+		&GetDriveInfoResponse{Label: "Data", Prefix: "D:", FreeSpace: 7, TotalSpace: 9}, func() Message { return &GetDriveInfoResponse{} }},
+	{StatPath,
+		&StatPathRequest{Path: "Home:/games/a.nsp"}, func() Message { return &StatPathRequest{} },
+		&StatPathResponse{Type: TypeFile, Size: 5 << 30}, func() Message { return &StatPathResponse{} }},
+	{GetFileCount,
+		&GetFileCountRequest{Path: "Home:/games"}, func() Message { return &GetFileCountRequest{} },
+		&GetFileCountResponse{Count: 12}, func() Message { return &GetFileCountResponse{} }},
+	{GetFile,
+		&GetFileRequest{Path: "Home:/games", Index: 4}, func() Message { return &GetFileRequest{} },
+		&GetFileResponse{Name: "a.nsp"}, func() Message { return &GetFileResponse{} }},
+	{GetDirectoryCount,
+		&GetDirectoryCountRequest{Path: "Home:/"}, func() Message { return &GetDirectoryCountRequest{} },
+		&GetDirectoryCountResponse{Count: 2}, func() Message { return &GetDirectoryCountResponse{} }},
+	{GetDirectory,
+		&GetDirectoryRequest{Path: "Home:/", Index: 1}, func() Message { return &GetDirectoryRequest{} },
+		&GetDirectoryResponse{Name: "games"}, func() Message { return &GetDirectoryResponse{} }},
+	{StartFile,
+		&StartFileRequest{Path: "Home:/dump.xci", Mode: ModeAppend}, func() Message { return &StartFileRequest{} },
+		&StartFileResponse{}, func() Message { return &StartFileResponse{} }},
+	{ReadFile,
+		&ReadFileRequest{Path: "Home:/a.nsp", Offset: 1 << 33, Size: 8 << 20}, func() Message { return &ReadFileRequest{} },
+		&ReadFileResponse{Size: 8 << 20}, func() Message { return &ReadFileResponse{} }},
+	{WriteFile,
+		&WriteFileRequest{Path: "Home:/dump.xci", Size: 1 << 20}, func() Message { return &WriteFileRequest{} },
+		&WriteFileResponse{}, func() Message { return &WriteFileResponse{} }},
+	{EndFile,
+		&EndFileRequest{Mode: ModeWrite}, func() Message { return &EndFileRequest{} },
+		&EndFileResponse{}, func() Message { return &EndFileResponse{} }},
+	{Create,
+		&CreateRequest{Type: TypeDirectory, Path: "Home:/new"}, func() Message { return &CreateRequest{} },
+		&CreateResponse{}, func() Message { return &CreateResponse{} }},
+	{Delete,
+		&DeleteRequest{Type: TypeFile, Path: "Home:/old"}, func() Message { return &DeleteRequest{} },
+		&DeleteResponse{}, func() Message { return &DeleteResponse{} }},
+	{Rename,
+		&RenameRequest{Type: TypeFile, Path: "Home:/a", NewPath: "Home:/b"}, func() Message { return &RenameRequest{} },
+		&RenameResponse{}, func() Message { return &RenameResponse{} }},
+	{GetSpecialPathCount,
+		&GetSpecialPathCountRequest{}, func() Message { return &GetSpecialPathCountRequest{} },
+		&GetSpecialPathCountResponse{Count: 2}, func() Message { return &GetSpecialPathCountResponse{} }},
+	{GetSpecialPath,
+		&GetSpecialPathRequest{Index: 1}, func() Message { return &GetSpecialPathRequest{} },
+		&GetSpecialPathResponse{Name: "Library", Path: "Home:/library"}, func() Message { return &GetSpecialPathResponse{} }},
+	{SelectFile,
+		&SelectFileRequest{}, func() Message { return &SelectFileRequest{} },
+		&SelectFileResponse{Path: "Home:/a.nsp"}, func() Message { return &SelectFileResponse{} }},
+}
+
+func TestEveryCommandIsCovered(t *testing.T) {
+	for i, c := range commands {
+		if c.id != ID(i+1) {
+			t.Fatalf("commands[%v] is %v, want %v", i, c.id, ID(i+1))
+		}
+	}
+	if len(commands) != int(SelectFile) {
+		t.Fatalf("got %v commands, want %v", len(commands), SelectFile)
+	}
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, c := range commands {
+		block, err := MarshalRequest(c.id, c.req)
+		if err != nil {
+			t.Fatalf("%v: %v", c.id, err)
+		}
+		if len(block) != BlockSize {
+			t.Fatalf("%v: got a %v bytes block", c.id, len(block))
+		}
+
+		id, d, err := UnmarshalRequest(block)
+		if err != nil {
+			t.Fatalf("%v: %v", c.id, err)
+		}
+		if id != c.id {
+			t.Fatalf("got id %v, want %v", id, c.id)
+		}
+		got := c.newReq()
+		if err := got.Decode(d); err != nil {
+			t.Fatalf("%v: %v", c.id, err)
+		}
+		if !reflect.DeepEqual(got, c.req) {
+			t.Errorf("%v: got %+v, want %+v", c.id, got, c.req)
+		}
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	for _, c := range commands {
+		block, err := MarshalResponse(c.resp)
+		if err != nil {
+			t.Fatalf("%v: %v", c.id, err)
+		}
+		if len(block) != BlockSize {
+			t.Fatalf("%v: got a %v bytes block", c.id, len(block))
+		}
+
+		got := c.newResp()
+		result, err := UnmarshalResponse(block, got)
+		if err != nil || result != 0 {
+			t.Fatalf("%v: got result %v, %v", c.id, result, err)
+		}
+		if !reflect.DeepEqual(got, c.resp) {
+			t.Errorf("%v: got %+v, want %+v", c.id, got, c.resp)
+		}
+	}
+}
+
+func TestFailure(t *testing.T) {
+	block := MarshalFailure(0xCA64)
+	if len(block) != BlockSize {
+		t.Fatalf("got a %v bytes block", len(block))
+	}
+
+	// The payload isn't decoded for failures.
+	m := &GetFileResponse{Name: "untouched"}
+	result, err := UnmarshalResponse(block, m)
+	if err != nil || result != 0xCA64 {
+		t.Fatalf("got result 0x%X, %v", result, err)
+	}
+	if m.Name != "untouched" {
+		t.Fatalf("failure decoded into %+v", m)
+	}
+}
+
+func TestInvalidMagic(t *testing.T) {
+	block, _ := MarshalResponse(nil)
+	if _, _, err := UnmarshalRequest(block); !errors.Is(err, ErrInvalidMagic) {
+		t.Fatalf("got %v, want invalid magic", err)
+	}
+
+	block, _ = MarshalRequest(GetDriveCount, nil)
+	if _, err := UnmarshalResponse(block, nil); !errors.Is(err, ErrInvalidMagic) {
+		t.Fatalf("got %v, want invalid magic", err)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	// Header, two lengths and both strings.
+	name := strings.Repeat("a", (BlockSize-16)/4)
+	if _, err := MarshalResponse(&GetSpecialPathResponse{Name: name, Path: name}); err != nil {
+		t.Fatalf("a full block failed: %v", err)
+	}
+	if _, err := MarshalResponse(&GetSpecialPathResponse{Name: name, Path: name + "a"}); !errors.Is(err, ErrBlockOverflow) {
+		t.Fatalf("got %v, want overflow", err)
+	}
+}
+
+func TestString(t *testing.T) {
+	if s := StatPath.String(); s != "StatPath" {
+		t.Fatalf("got %v", s)
+	}
+	if s := ID(99).String(); s != "ID(99)" {
+		t.Fatalf("got %v", s)
+	}
+}
@@ -2,20 +2,33 @@ package quark
 
 import (
 	"context"
+	"fmt"
 	"log"
 
 	"github.com/bitrvmpd/goquark/internal/pkg/usb"
 )
 
-func Listen(ctx context.Context) {
-	c, err := usb.New(ctx)
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't initialize command interface: %v", err)
-	}
+// Serves Goldleaf through m to every console reported by w until ctx is done.
+func Listen(ctx context.Context, w *usb.Watcher, m *usb.Manager) {
+	// Start serving consoles
+	go m.Run()
+
+	fmt.Println("Waiting for USB devices to appear...")
 
-	// Start listening for USB Packets
-	go c.ProcessUSBPackets()
+	events, cancel := w.Subscribe()
+	defer cancel()
 
-	// Wait for exit
-	<-ctx.Done()
+	// Wait for exit, telling about devices coming and going.
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				<-ctx.Done()
+				return
+			}
+			log.Printf("INFO: %v", e)
+		}
+	}
 }
@@ -0,0 +1,115 @@
+// Package result maps goQuark errors to the result codes sent to Goldleaf.
+package result
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/protocol"
+	"github.com/bitrvmpd/goquark/internal/pkg/sandbox"
+)
+
+// Code follows Horizon's result layout, the module in the lower 9 bits and
+// the description above it. Goldleaf treats anything but Success as a failure
+// and shows it as 2XXX-YYYY, so every code must be unique.
+type Code uint32
+
+// Goldleaf's result module.
+const module = 356
+
+func makeCode(desc uint32) Code {
+	return Code(module | desc<<9)
+}
+
+const Success Code = 0
+
+// Descriptions start at 100 to stay clear of the ones Goldleaf uses for itself.
+var (
+	Unknown        = makeCode(100)
+	NotFound       = makeCode(101)
+	AccessDenied   = makeCode(102)
+	NoSpace        = makeCode(103)
+	InvalidIndex   = makeCode(104)
+	InvalidPath    = makeCode(105)
+	InvalidType    = makeCode(106)
+	AlreadyExists  = makeCode(107)
+	InvalidCommand = makeCode(108)
+	FileNotOpen    = makeCode(109)
+	InvalidRange   = makeCode(110)
+	// Goldleaf version outside the supported range.
+	UnsupportedVersion = makeCode(111)
+	// Command ID goQuark doesn't know about.
+	UnsupportedCommand = makeCode(112)
+	// Payload that doesn't fit its block or breaks the protocol limits.
+	InvalidPayload = makeCode(113)
+	// Response not fitting in a block, like a very long path.
+	ResponseTooLarge = makeCode(114)
+)
+
+// Errors for requests Goldleaf shouldn't have sent.
+var (
+	ErrInvalidIndex = errors.New("invalid index")
+	ErrInvalidPath  = errors.New("invalid path")
+	ErrInvalidType  = errors.New("invalid type")
+	ErrFileNotOpen  = errors.New("file not open")
+	ErrInvalidRange = errors.New("invalid range")
+
+	ErrUnsupportedVersion = errors.New("unsupported Goldleaf version")
+	// Operation the folder's permissions don't allow.
+	ErrNotPermitted = errors.New("not permitted")
+)
+
+// Checked in order, the first match wins.
+var table = []struct {
+	err  error
+	code Code
+}{
+	{ErrInvalidIndex, InvalidIndex},
+	{ErrInvalidPath, InvalidPath},
+	{ErrInvalidType, InvalidType},
+	{ErrFileNotOpen, FileNotOpen},
+	{ErrInvalidRange, InvalidRange},
+	{ErrUnsupportedVersion, UnsupportedVersion},
+	{protocol.ErrMalformed, InvalidPayload},
+	{protocol.ErrBlockOverflow, ResponseTooLarge},
+	{sandbox.ErrOutside, AccessDenied},
+	{ErrNotPermitted, AccessDenied},
+	{os.ErrNotExist, NotFound},
+	{os.ErrPermission, AccessDenied},
+	{os.ErrExist, AlreadyExists},
+	{syscall.EROFS, AccessDenied},
+	{syscall.ENOSPC, NoSpace},
+	{syscall.EDQUOT, NoSpace},
+	{syscall.ENOTDIR, InvalidPath},
+	{syscall.EISDIR, InvalidPath},
+	{syscall.ENAMETOOLONG, InvalidPath},
+	{syscall.EINVAL, InvalidPath},
+}
+
+// Returns the code Goldleaf should get for err.
+func FromError(err error) Code {
+	if err == nil {
+		return Success
+	}
+	for _, e := range table {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return Unknown
+}
+
+func (c Code) Module() uint32 {
+	return uint32(c) & 0x1FF
+}
+
+func (c Code) Description() uint32 {
+	return (uint32(c) >> 9) & 0x1FFF
+}
+
+// Formats the code the way Goldleaf displays it.
+func (c Code) String() string {
+	return fmt.Sprintf("%04d-%04d", 2000+c.Module(), c.Description())
+}
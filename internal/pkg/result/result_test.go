@@ -0,0 +1,56 @@
+package result
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/protocol"
+	"github.com/bitrvmpd/goquark/internal/pkg/sandbox"
+)
+
+func TestFromError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want Code
+	}{
+		{nil, Success},
+		{errors.New("boom"), Unknown},
+		{&os.PathError{Op: "open", Path: "/x", Err: syscall.ENOENT}, NotFound},
+		{&os.PathError{Op: "open", Path: "/x", Err: syscall.EACCES}, AccessDenied},
+		{&os.PathError{Op: "mkdir", Path: "/x", Err: syscall.EEXIST}, AlreadyExists},
+		{&os.PathError{Op: "write", Path: "/x", Err: syscall.ENOSPC}, NoSpace},
+		{&os.PathError{Op: "open", Path: "/x", Err: syscall.ENOTDIR}, InvalidPath},
+		{fmt.Errorf("%w: file 3", ErrInvalidIndex), InvalidIndex},
+		{fmt.Errorf("%w: 7", ErrInvalidType), InvalidType},
+		{fmt.Errorf("%w: 1.0.0", ErrUnsupportedVersion), UnsupportedVersion},
+		{fmt.Errorf("%w: string too long", protocol.ErrMalformed), InvalidPayload},
+		{fmt.Errorf("%w: 4098 bytes", protocol.ErrBlockOverflow), ResponseTooLarge},
+		{fmt.Errorf("%w: /etc", sandbox.ErrOutside), AccessDenied},
+		{fmt.Errorf("%w: delete /games", ErrNotPermitted), AccessDenied},
+	}
+
+	for _, tt := range tests {
+		if got := FromError(tt.err); got != tt.want {
+			t.Errorf("FromError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestCodesAreUnique(t *testing.T) {
+	seen := map[Code]bool{}
+	for _, c := range []Code{Success, Unknown, NotFound, AccessDenied, NoSpace, InvalidIndex, InvalidPath, InvalidType, AlreadyExists, InvalidCommand, FileNotOpen, InvalidRange, UnsupportedVersion, UnsupportedCommand, InvalidPayload, ResponseTooLarge} {
+		if seen[c] {
+			t.Fatalf("duplicated code %v", c)
+		}
+		seen[c] = true
+	}
+}
+
+func TestString(t *testing.T) {
+	if s := NotFound.String(); s != "2356-0101" {
+		t.Fatalf("got %v, want 2356-0101", s)
+	}
+}
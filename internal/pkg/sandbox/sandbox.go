@@ -0,0 +1,187 @@
+// Package sandbox confines the paths sent by Goldleaf to the served folders.
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/fs"
+)
+
+// Returned for paths resolving outside every root.
+var ErrOutside = errors.New("path outside the served folders")
+
+// Sandbox resolves paths against a set of root folders. Both are compared
+// once their symlinks are resolved, so links can't be used to escape.
+type Sandbox struct {
+	roots []root
+}
+
+// Root is a folder to confine paths to, in the filesystem backing it.
+type Root struct {
+	Path string
+	FS   fs.FS
+}
+
+type root struct {
+	path string
+	fs   fs.FS
+	// Position in the folders given to NewRoots.
+	index int
+}
+
+// Creates a sandbox over dirs in the local filesystem.
+func New(dirs ...string) *Sandbox {
+	roots := make([]Root, len(dirs))
+	for i, d := range dirs {
+		roots[i] = Root{d, fs.OS}
+	}
+	return NewRoots(roots...)
+}
+
+// Creates a sandbox over roots. Folders that can't be resolved, like
+// missing ones, are skipped.
+func NewRoots(roots ...Root) *Sandbox {
+	s := &Sandbox{}
+	for i, r := range roots {
+		abs, err := filepath.Abs(r.Path)
+		if err != nil {
+			log.Printf("ERROR: Not serving %v. %v", r.Path, err)
+			continue
+		}
+		real, err := evalRoot(r.FS, abs)
+		if err != nil {
+			log.Printf("ERROR: Not serving %v. %v", r.Path, err)
+			continue
+		}
+		s.roots = append(s.roots, root{real, r.FS, i})
+	}
+	return s
+}
+
+func evalRoot(fsys fs.FS, p string) (string, error) {
+	if l, ok := fsys.(fs.Linker); ok {
+		return l.EvalSymlinks(p)
+	}
+	if _, err := fsys.Stat(p); err != nil {
+		return "", err
+	}
+	return filepath.Clean(p), nil
+}
+
+// Returns the roots, with their symlinks resolved.
+func (s *Sandbox) Roots() []string {
+	roots := make([]string, len(s.roots))
+	for i, r := range s.roots {
+		roots[i] = r.path
+	}
+	return roots
+}
+
+// Resolves p, an absolute local path, to where it really points to.
+// Fails with ErrOutside unless that's one of the roots or inside them.
+// p doesn't need to exist, so files and folders can be created.
+func (s *Sandbox) Resolve(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("%w: %v isn't absolute", ErrOutside, p)
+	}
+
+	// Cleaning first takes care of any "..".
+	clean := filepath.Clean(p)
+
+	// Each root resolves p in its own filesystem, the innermost holding it wins.
+	var best *root
+	var real string
+	var firstErr error
+	for i, r := range s.roots {
+		rp, err := evalExisting(r.fs, clean)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if Within(r.path, rp) && (best == nil || len(r.path) > len(best.path)) {
+			best, real = &s.roots[i], rp
+		}
+	}
+
+	if best == nil {
+		if firstErr != nil {
+			return "", firstErr
+		}
+		return "", fmt.Errorf("%w: %v", ErrOutside, p)
+	}
+	return real, nil
+}
+
+// Reports whether p, as returned by Resolve, is one of the roots.
+func (s *Sandbox) IsRoot(p string) bool {
+	for _, r := range s.roots {
+		if p == r.path {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the position, among the folders given to New, of the one
+// holding p, as returned by Resolve. Nested folders pick the innermost.
+func (s *Sandbox) Root(p string) (int, bool) {
+	best := -1
+	for i, r := range s.roots {
+		if Within(r.path, p) && (best < 0 || len(r.path) > len(s.roots[best].path)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	return s.roots[best].index, true
+}
+
+// Resolves the symlinks of the longest existing part of p,
+// appending the rest as is. p must be clean.
+func evalExisting(fsys fs.FS, p string) (string, error) {
+	l, ok := fsys.(fs.Linker)
+	if !ok {
+		// Nothing to resolve without links.
+		return p, nil
+	}
+
+	rest := ""
+	for {
+		real, err := l.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+
+		// A dangling link would be followed once created.
+		if _, err := l.Lstat(p); err == nil {
+			return "", fmt.Errorf("%w: %v is a dangling link", ErrOutside, p)
+		}
+
+		parent := filepath.Dir(p)
+		if parent == p {
+			return filepath.Join(p, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+}
+
+// Reports whether p is root or inside it. Both must be absolute and clean.
+func Within(root string, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,183 @@
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/fs"
+)
+
+// Returns a served folder and a sibling outside it, symlinks resolved.
+func newTree(t *testing.T) (string, string) {
+	t.Helper()
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "served")
+	outside := filepath.Join(base, "private")
+	for _, d := range []string{filepath.Join(root, "games"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, outside
+}
+
+func TestResolve(t *testing.T) {
+	root, outside := newTree(t)
+	s := New(root)
+
+	allowed := map[string]string{
+		root:                                     root,
+		filepath.Join(root, "games"):             filepath.Join(root, "games"),
+		filepath.Join(root, "games", "new.nsp"):  filepath.Join(root, "games", "new.nsp"),
+		filepath.Join(root, "new", "dir", "a"):   filepath.Join(root, "new", "dir", "a"),
+		filepath.Join(root, "games", "..", "x"):  filepath.Join(root, "x"),
+		root + "/./games//":                      filepath.Join(root, "games"),
+		filepath.Join(root, "..", "served", "g"): filepath.Join(root, "g"),
+	}
+	for p, want := range allowed {
+		got, err := s.Resolve(p)
+		if err != nil {
+			t.Errorf("Resolve(%v): %v", p, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("Resolve(%v) = %v, want %v", p, got, want)
+		}
+	}
+
+	denied := []string{
+		outside,
+		filepath.Join(outside, "secret"),
+		filepath.Join(root, ".."),
+		filepath.Join(root, "..", "private"),
+		root + "/../../../../etc/passwd",
+		root + "-suffix",
+		"/",
+		"relative/path",
+		"",
+	}
+	for _, p := range denied {
+		if got, err := s.Resolve(p); !errors.Is(err, ErrOutside) {
+			t.Errorf("Resolve(%q) = %v, %v, want ErrOutside", p, got, err)
+		}
+	}
+}
+
+func TestSymlinkEscapes(t *testing.T) {
+	root, outside := newTree(t)
+	s := New(root)
+
+	// Links leaving the root, to a folder, a file and nowhere.
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skip("symlinks not supported.", err)
+	}
+	secret := filepath.Join(outside, "secret")
+	if err := os.WriteFile(secret, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(root, "games", "secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	// A link staying inside is fine.
+	if err := os.Symlink(filepath.Join(root, "games"), filepath.Join(root, "library")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{
+		filepath.Join(root, "escape"),
+		filepath.Join(root, "escape", "secret"),
+		filepath.Join(root, "escape", "new.txt"),
+		filepath.Join(root, "games", "secret"),
+		filepath.Join(root, "dangling"),
+	} {
+		if got, err := s.Resolve(p); !errors.Is(err, ErrOutside) {
+			t.Errorf("Resolve(%v) = %v, %v, want ErrOutside", p, got, err)
+		}
+	}
+
+	got, err := s.Resolve(filepath.Join(root, "library", "a.nsp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, "games", "a.nsp"); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestRoots(t *testing.T) {
+	root, outside := newTree(t)
+	s := New(root, filepath.Join(outside, "missing"), outside)
+
+	if len(s.Roots()) != 2 {
+		t.Fatalf("got roots %v", s.Roots())
+	}
+	if !s.IsRoot(root) || !s.IsRoot(outside) || s.IsRoot(filepath.Join(root, "games")) {
+		t.Fatalf("IsRoot is wrong for %v", s.Roots())
+	}
+
+	// Without roots nothing is served.
+	if _, err := New().Resolve(root); !errors.Is(err, ErrOutside) {
+		t.Fatalf("got %v, want ErrOutside", err)
+	}
+}
+
+func TestRootPicksInnermost(t *testing.T) {
+	root, outside := newTree(t)
+	games := filepath.Join(root, "games")
+	s := New(filepath.Join(outside, "missing"), root, games)
+
+	tests := map[string]int{
+		root:                          1,
+		filepath.Join(root, "a.nsp"):  1,
+		games:                         2,
+		filepath.Join(games, "b.nsp"): 2,
+		filepath.Join(root, "games2"): 1,
+	}
+	for p, want := range tests {
+		if got, ok := s.Root(p); !ok || got != want {
+			t.Errorf("Root(%v) = %v %v, want %v", p, got, ok, want)
+		}
+	}
+	if _, ok := s.Root(outside); ok {
+		t.Errorf("Root(%v) found a folder", outside)
+	}
+}
+
+func TestRootsInOtherFilesystems(t *testing.T) {
+	root, outside := newTree(t)
+	mem := fs.NewMemFS()
+	games := filepath.Join(string(filepath.Separator), "mem", "games")
+	if err := fs.MkdirAll(mem, games, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := NewRoots(Root{root, fs.OS}, Root{games, mem}, Root{filepath.Join(string(filepath.Separator), "missing"), mem})
+
+	tests := map[string]int{
+		filepath.Join(root, "a.nsp"):  0,
+		filepath.Join(games, "a.nsp"): 1,
+		games + "/new/../b.nsp":       1,
+	}
+	for p, want := range tests {
+		real, err := s.Resolve(p)
+		if err != nil {
+			t.Fatalf("Resolve(%v): %v", p, err)
+		}
+		if got, ok := s.Root(real); !ok || got != want {
+			t.Errorf("Root(%v) = %v %v, want %v", real, got, ok, want)
+		}
+	}
+
+	for _, p := range []string{games + "/../other", outside, filepath.Join(string(filepath.Separator), "missing", "x")} {
+		if got, err := s.Resolve(p); !errors.Is(err, ErrOutside) {
+			t.Errorf("Resolve(%v) = %v, %v, want ErrOutside", p, got, err)
+		}
+	}
+}
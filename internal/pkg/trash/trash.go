@@ -0,0 +1,200 @@
+// Package trash keeps what Goldleaf deletes so it can be restored.
+package trash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/fs"
+)
+
+// Name of the trash inside a served folder, unless configured otherwise.
+const DefaultDir = ".goquark-trash"
+
+// Returned when no item has the requested ID.
+var ErrNotFound = errors.New("not in the trash")
+
+// Entry describes a trashed file or directory.
+type Entry struct {
+	ID string `json:"id"`
+	// Where it was deleted from.
+	Path    string    `json:"path"`
+	Deleted time.Time `json:"deleted"`
+	// Goldleaf's version of the console that deleted it.
+	Serial string `json:"serial"`
+}
+
+// Trash keeps deleted items in files/ and their entries in info/.
+// Items are renamed in, so it must be on the same filesystem as them.
+type Trash struct {
+	fs  fs.FS
+	dir string
+}
+
+// Creates the trash kept at dir in fsys.
+func New(fsys fs.FS, dir string) *Trash {
+	return &Trash{fsys, dir}
+}
+
+func (t *Trash) Dir() string {
+	return t.dir
+}
+
+func (t *Trash) files(id string) string {
+	return filepath.Join(t.dir, "files", id)
+}
+
+func (t *Trash) info(id string) string {
+	return filepath.Join(t.dir, "info", id+".json")
+}
+
+// Moves path to the trash, recording serial as who deleted it.
+func (t *Trash) Put(path string, serial string) (Entry, error) {
+	for _, d := range []string{"files", "info"} {
+		if err := fs.MkdirAll(t.fs, filepath.Join(t.dir, d), 0755); err != nil {
+			return Entry{}, fmt.Errorf("couldn't create trash %v. %w", t.dir, err)
+		}
+	}
+
+	e := Entry{Path: path, Deleted: time.Now(), Serial: serial}
+	f, err := t.create(&e)
+	if err != nil {
+		return Entry{}, err
+	}
+	err = json.NewEncoder(f).Encode(e)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.fs.Remove(t.info(e.ID))
+		return Entry{}, fmt.Errorf("couldn't write %v. %w", t.info(e.ID), err)
+	}
+
+	if err := t.fs.Rename(path, t.files(e.ID)); err != nil {
+		t.fs.Remove(t.info(e.ID))
+		return Entry{}, fmt.Errorf("couldn't move %v to %v. %w", path, t.dir, err)
+	}
+	return e, nil
+}
+
+// Creates the info file of e, picking an ID not taken yet.
+func (t *Trash) create(e *Entry) (fs.File, error) {
+	n := e.Deleted.UnixNano()
+	for {
+		e.ID = strconv.FormatInt(n, 36)
+		f, err := t.fs.OpenFile(t.info(e.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("couldn't create %v. %w", t.info(e.ID), err)
+		}
+		n++
+	}
+}
+
+// Returns the trashed items, oldest first. A missing trash is empty.
+func (t *Trash) List() ([]Entry, error) {
+	infos, err := t.fs.ReadDir(filepath.Join(t.dir, "info"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list trash %v. %w", t.dir, err)
+	}
+
+	var entries []Entry
+	for _, fi := range infos {
+		id := strings.TrimSuffix(fi.Name(), ".json")
+		if fi.IsDir() || id == fi.Name() {
+			continue
+		}
+		e, err := t.entry(id)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Deleted.Before(entries[j].Deleted) })
+	return entries, nil
+}
+
+func (t *Trash) entry(id string) (Entry, error) {
+	// IDs come from users too, don't let them point elsewhere.
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return Entry{}, fmt.Errorf("%w: %q", ErrNotFound, id)
+	}
+	b, err := fs.ReadFile(t.fs, t.info(id))
+	if os.IsNotExist(err) {
+		return Entry{}, fmt.Errorf("%w: %v", ErrNotFound, id)
+	}
+	if err != nil {
+		return Entry{}, fmt.Errorf("couldn't read %v. %w", t.info(id), err)
+	}
+
+	var e Entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return Entry{}, fmt.Errorf("couldn't decode %v. %w", t.info(id), err)
+	}
+	e.ID = id
+	return e, nil
+}
+
+// Moves the item back where it was deleted from, creating the missing
+// directories. Fails if something took its place since.
+func (t *Trash) Restore(id string) (Entry, error) {
+	e, err := t.entry(id)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	if _, err := t.fs.Stat(e.Path); err == nil {
+		return Entry{}, fmt.Errorf("couldn't restore %v. %w", e.Path, os.ErrExist)
+	}
+	if err := fs.MkdirAll(t.fs, filepath.Dir(e.Path), 0755); err != nil {
+		return Entry{}, fmt.Errorf("couldn't restore %v. %w", e.Path, err)
+	}
+	if err := t.fs.Rename(t.files(id), e.Path); err != nil {
+		return Entry{}, fmt.Errorf("couldn't restore %v. %w", e.Path, err)
+	}
+	return e, t.fs.Remove(t.info(id))
+}
+
+// Deletes the item for good.
+func (t *Trash) Remove(id string) error {
+	if _, err := t.entry(id); err != nil {
+		return err
+	}
+	if err := fs.RemoveAll(t.fs, t.files(id)); err != nil {
+		return fmt.Errorf("couldn't remove %v. %w", t.files(id), err)
+	}
+	return t.fs.Remove(t.info(id))
+}
+
+// Deletes for good the items deleted before the given time,
+// returning how many were.
+func (t *Trash) Purge(before time.Time) (int, error) {
+	entries, err := t.List()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, e := range entries {
+		if !e.Deleted.Before(before) {
+			break
+		}
+		if err := t.Remove(e.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
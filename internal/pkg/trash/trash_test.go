@@ -0,0 +1,124 @@
+package trash
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/fs"
+)
+
+func writeFile(t *testing.T, path string, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutAndRestore(t *testing.T) {
+	root := t.TempDir()
+	tr := New(fs.OS, filepath.Join(root, DefaultDir))
+	file := filepath.Join(root, "a.nsp")
+	dir := filepath.Join(root, "dumps", "2021")
+	writeFile(t, file, "game")
+	writeFile(t, filepath.Join(dir, "save.bin"), "save")
+
+	e1, err := tr.Put(file, "0.10.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2, err := tr.Put(dir, "0.9.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e1.ID == e2.ID {
+		t.Fatalf("both items got ID %v", e1.ID)
+	}
+	for _, p := range []string{file, dir} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("%v wasn't moved. %v", p, err)
+		}
+	}
+
+	entries, err := tr.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Path != file || entries[0].Serial != "0.10.0" || entries[1].Path != dir || entries[1].Serial != "0.9.0" {
+		t.Fatalf("got entries %+v", entries)
+	}
+
+	// Restoring recreates the parents that went away meanwhile.
+	if err := os.Remove(filepath.Join(root, "dumps")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.Restore(e2.ID); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "save.bin")); err != nil || string(b) != "save" {
+		t.Fatalf("got %q. %v", b, err)
+	}
+
+	// Something else took the place of the file.
+	writeFile(t, file, "other")
+	if _, err := tr.Restore(e1.ID); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("got %v, want ErrExist", err)
+	}
+	if b, _ := ioutil.ReadFile(file); string(b) != "other" {
+		t.Fatalf("restore replaced %v", file)
+	}
+
+	if entries, _ := tr.List(); len(entries) != 1 || entries[0].ID != e1.ID {
+		t.Fatalf("got entries %+v", entries)
+	}
+}
+
+func TestUnknownIDs(t *testing.T) {
+	tr := New(fs.OS, filepath.Join(t.TempDir(), DefaultDir))
+
+	if entries, err := tr.List(); err != nil || len(entries) != 0 {
+		t.Fatalf("got %v %v for a missing trash", entries, err)
+	}
+	for _, id := range []string{"", "missing", "../info/x", ".."} {
+		if _, err := tr.Restore(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Restore(%q): got %v, want ErrNotFound", id, err)
+		}
+		if err := tr.Remove(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Remove(%q): got %v, want ErrNotFound", id, err)
+		}
+	}
+}
+
+func TestPurge(t *testing.T) {
+	root := t.TempDir()
+	tr := New(fs.OS, filepath.Join(root, DefaultDir))
+	for _, name := range []string{"a", "b", "c"} {
+		writeFile(t, filepath.Join(root, name), name)
+		if _, err := tr.Put(filepath.Join(root, name), "0.10.0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, _ := tr.List()
+
+	n, err := tr.Purge(entries[1].Deleted)
+	if err != nil || n != 1 {
+		t.Fatalf("purged %v. %v", n, err)
+	}
+	if _, err := os.Stat(tr.files(entries[0].ID)); !os.IsNotExist(err) {
+		t.Fatalf("%v is still there. %v", entries[0].ID, err)
+	}
+
+	n, err = tr.Purge(time.Now().Add(time.Second))
+	if err != nil || n != 2 {
+		t.Fatalf("purged %v. %v", n, err)
+	}
+	if entries, _ := tr.List(); len(entries) != 0 {
+		t.Fatalf("got entries %+v", entries)
+	}
+}
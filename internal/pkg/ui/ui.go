@@ -8,6 +8,7 @@ import (
 
 	"github.com/bitrvmpd/goquark/internal/pkg/cfg"
 	"github.com/bitrvmpd/goquark/internal/pkg/quark"
+	"github.com/bitrvmpd/goquark/internal/pkg/usb"
 	"github.com/getlantern/systray"
 	"github.com/sqweek/dialog"
 )
@@ -25,12 +26,15 @@ func Build() {
 func onReady() {
 	folders = make(map[int]*systray.MenuItem, cfg.Size())
 	started := false
+	// Manager of the running client, nil while stopped.
+	var m *usb.Manager
 	//systray.SetIcon(icon.Data)
 	systray.SetTitle("goQuark")
 	systray.SetTooltip("")
 	mStart := systray.AddMenuItem("Start", "Starts communication")
 	mStatus := systray.AddMenuItem("Client Stopped", "Show client status")
 	mStatus.Disable()
+	mReadOnly := systray.AddMenuItemCheckbox("Read-only", "Refuses creating, deleting, renaming and writing files", false)
 	systray.AddSeparator()
 
 	// Sets the icon of a menu item. Only available on Mac and Windows.
@@ -75,6 +79,7 @@ func onReady() {
 				// Stops the client
 				cancel()
 				started = false
+				m = nil
 				mStart.SetTitle("Start")
 				mStatus.SetTitle("Client Stopped")
 				mPaths.Enable()
@@ -83,12 +88,28 @@ func onReady() {
 
 			ctx = context.Background()
 			ctx, cancel = context.WithCancel(ctx)
-			go quark.Listen(ctx)
+			w := usb.NewWatcher(ctx)
+			opts := usb.DefaultOptions
+			opts.ReadOnly = mReadOnly.Checked()
+			m = usb.NewManager(ctx, w, opts)
+			go quark.Listen(ctx, w, m)
+			go showDeviceStatus(ctx, m, mStatus)
 			started = true
 			mStart.SetTitle("Stop")
 			mStatus.SetTitle("Ready for connection")
 			mPaths.Disable()
 
+		case <-mReadOnly.ClickedCh:
+			if mReadOnly.Checked() {
+				mReadOnly.Uncheck()
+			} else {
+				mReadOnly.Check()
+			}
+			// Running sessions switch right away.
+			if m != nil {
+				m.SetReadOnly(mReadOnly.Checked())
+			}
+
 		case <-mPath.ClickedCh:
 			f, err := dialog.Directory().Browse()
 			if err != nil {
@@ -106,6 +127,40 @@ func onReady() {
 
 }
 
+// Reflects consoles coming and going in the status item.
+func showDeviceStatus(ctx context.Context, m *usb.Manager, mStatus *systray.MenuItem) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.Updates():
+			sessions := m.Sessions()
+			if ctx.Err() != nil {
+				return
+			}
+			mStatus.SetTitle(statusTitle(sessions))
+		}
+	}
+}
+
+func statusTitle(sessions []usb.SessionInfo) string {
+	// Tell about unsupported Goldleaf first, it won't work until updated.
+	for _, s := range sessions {
+		if !s.Supported {
+			return fmt.Sprintf("Goldleaf %v unsupported (needs >= %v, < %v)", s.Serial, usb.MinGoldleafVersion, usb.MaxGoldleafVersion)
+		}
+	}
+
+	switch len(sessions) {
+	case 0:
+		return "Ready for connection"
+	case 1:
+		return "Switch connected"
+	default:
+		return fmt.Sprintf("%v Switches connected", len(sessions))
+	}
+}
+
 func onExit() {
 	if cancel == nil {
 		log.Println("ERROR: Couldn't call cancel")
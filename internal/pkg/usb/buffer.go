@@ -3,16 +3,18 @@ package usb
 import (
 	"bytes"
 	"encoding/binary"
-	"log"
+	"fmt"
 
-	"golang.org/x/text/encoding/unicode"
+	"github.com/bitrvmpd/goquark/internal/pkg/protocol"
+	"github.com/bitrvmpd/goquark/internal/pkg/result"
 )
 
 type buffer struct {
-	in_buff  bytes.Buffer
+	// Decodes the last block read.
+	in       *protocol.Decoder
 	out_buff bytes.Buffer
 
-	usb *USBInterface
+	usb Transport
 }
 
 func (c *buffer) responseStart() {
@@ -34,19 +36,23 @@ func (c *buffer) responseStart() {
 	c.out_buff.Write(d)
 }
 
-func (c *buffer) responseEnd() {
+// Goldleaf reads a single block per response and has no way to continue
+// one in the next, so responses not fitting in it fail without sending anything.
+func (c *buffer) responseEnd() error {
+	if n := c.out_buff.Len(); n > BlockSize {
+		c.out_buff.Reset()
+		return fmt.Errorf("%w: response of %v bytes", protocol.ErrBlockOverflow, n)
+	}
+
 	// Fill with 0 up to 4096 bytes
 	d := make([]byte, BlockSize-c.out_buff.Len())
 	c.out_buff.Write(d)
 
 	// Write the buffer
-	_, err := c.usb.Write(c.out_buff.Bytes())
-	if err != nil {
-		log.Fatalf("ERROR: %v", err)
-	}
+	return c.writeRaw(c.out_buff.Bytes())
 }
 
-func (c *buffer) respondFailure(r uint32) {
+func (c *buffer) respondFailure(r result.Code) error {
 	// Empty our out buffer
 	c.out_buff.Reset()
 
@@ -57,90 +63,97 @@ func (c *buffer) respondFailure(r uint32) {
 
 	// Append error
 	b := make([]byte, 4)
-	binary.LittleEndian.PutUint32(b, r)
+	binary.LittleEndian.PutUint32(b, uint32(r))
 	c.out_buff.Write(b)
 
-	c.responseEnd()
+	return c.responseEnd()
 }
 
-func (c *buffer) respondEmpty() {
+func (c *buffer) respondEmpty() error {
 	c.responseStart()
-	c.responseEnd()
+	return c.responseEnd()
 }
 
-func (c *buffer) readInt32() (int, error) {
-	d := make([]byte, 4)
-	_, err := c.in_buff.Read(d)
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't read from buffer!. %v", err)
+// Sends r, followed by its stream if it has one.
+// Returns a protocol.ErrBlockOverflow error if r doesn't fit in a block,
+// so the request can still be failed.
+func (c *buffer) respond(r *Response) error {
+	if r == nil {
+		return c.respondEmpty()
+	}
+
+	c.responseStart()
+	c.out_buff.Write(r.out.Bytes())
+	if err := c.responseEnd(); err != nil {
+		if r.stream != nil {
+			// Lets the stream release whatever it holds.
+			r.stream(func([]byte) error { return err })
+		}
+		return err
 	}
-	i := binary.LittleEndian.Uint32(d)
-	return int(i), nil
+
+	if r.stream == nil {
+		return nil
+	}
+	if err := r.stream(c.writeRaw); err != nil && !isTransportError(err) {
+		return &transportError{err}
+	}
+	return nil
+}
+
+func (c *buffer) readInt32() (int, error) {
+	i, err := c.in.Uint32()
+	return int(i), err
 }
 
 func (c *buffer) readInt64() (int64, error) {
-	d := make([]byte, 8)
-	_, err := c.in_buff.Read(d)
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't read from buffer!. %v", err)
-	}
-	i := binary.LittleEndian.Uint64(d)
-	return int64(i), nil
+	return c.in.Int64()
 }
 
 func (c *buffer) readFromUSB() error {
-	c.in_buff.Reset()
 	b := make([]byte, BlockSize)
-	_, err := c.usb.Read(b)
-	if err != nil {
+	if err := c.readRaw(b); err != nil {
 		return err
 	}
-	c.in_buff.Write(b)
+	c.in = protocol.NewDecoder(b)
 	return nil
 }
 
-func (c *buffer) writeInt32(n uint32) {
-	b := make([]byte, 4)
-	binary.LittleEndian.PutUint32(b, n)
-	c.out_buff.Write(b)
-}
-func (c *buffer) writeInt64(n uint64) {
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, n)
-	c.out_buff.Write(b)
+// Reads p straight from the transport, bypassing in_buff.
+func (c *buffer) readRaw(p []byte) error {
+	if _, err := c.usb.Read(p); err != nil {
+		return &transportError{err}
+	}
+	return nil
 }
 
-func (c *buffer) readString() (string, error) {
-	//Pop the size
-	size, err := c.readInt32()
-	if err != nil {
-		return "", err
+// Reads and drops the next n bytes from the transport, a chunk at a time.
+func (c *buffer) skipRaw(n int64) error {
+	bp := chunkPool.Get().(*[]byte)
+	defer chunkPool.Put(bp)
+	b := *bp
+
+	for n > 0 {
+		chunk := b
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		if err := c.readRaw(chunk); err != nil {
+			return err
+		}
+		n -= int64(len(chunk))
 	}
+	return nil
+}
 
-	o := make([]byte, size)
-	enc := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewDecoder()
-	_, _, err = enc.Transform(o, c.in_buff.Next(size*2), false)
-	if err != nil {
-		return "", err
+// Writes p straight to the transport, bypassing out_buff.
+func (c *buffer) writeRaw(p []byte) error {
+	if _, err := c.usb.Write(p); err != nil {
+		return &transportError{err}
 	}
-
-	// Convert num of bytes reported by enc.Transform
-	s := string(o)
-
-	return s, nil
+	return nil
 }
 
-func (c *buffer) writeString(v string) {
-	o := make([]byte, BlockSize)
-
-	// Prepare encoder
-	enc := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder()
-	nDst, _, err := enc.Transform(o, []byte(v), false)
-
-	//Write len of chars.
-	c.writeInt32(uint32(len(v)))
-	if err != nil {
-		log.Fatalf("ERROR: Can't write string: %v", err)
-	}
-	c.out_buff.Write(o[:nDst])
+func (c *buffer) readString() (string, error) {
+	return c.in.String()
 }
@@ -1,26 +1,30 @@
 package usb
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/bitrvmpd/goquark/internal/pkg/cfg"
 	fsUtil "github.com/bitrvmpd/goquark/internal/pkg/fs"
-)
-
-type ID uint8
-
-var (
-	fileReader *os.File
-	fileWriter *os.File
+	"github.com/bitrvmpd/goquark/internal/pkg/protocol"
+	"github.com/bitrvmpd/goquark/internal/pkg/result"
+	"github.com/bitrvmpd/goquark/internal/pkg/sandbox"
+	"github.com/bitrvmpd/goquark/internal/pkg/trash"
 )
 
 const (
-	BlockSize = 0x1000
-	GLCI      = 0x49434C47
-	GLCO      = 0x4F434C47
+	BlockSize = protocol.BlockSize
+	GLCI      = protocol.GLCI
+	GLCO      = protocol.GLCO
 	header    = `
 	####################################
 	###### < < G O  Q U A R K > > ######
@@ -36,41 +40,92 @@ const (
 `
 )
 
+// ID identifies a command, see the protocol package for the built-in ones.
+type ID = protocol.ID
+
 const (
-	Invalid ID = iota
-	GetDriveCount
-	GetDriveInfo
-	StatPath
-	GetFileCount
-	GetFile
-	GetDirectoryCount
-	GetDirectory
-	StartFile
-	ReadFile
-	WriteFile
-	EndFile
-	Create
-	Delete
-	Rename
-	GetSpecialPathCount
-	GetSpecialPath
-	SelectFile
+	Invalid             = protocol.Invalid
+	GetDriveCount       = protocol.GetDriveCount
+	GetDriveInfo        = protocol.GetDriveInfo
+	StatPath            = protocol.StatPath
+	GetFileCount        = protocol.GetFileCount
+	GetFile             = protocol.GetFile
+	GetDirectoryCount   = protocol.GetDirectoryCount
+	GetDirectory        = protocol.GetDirectory
+	StartFile           = protocol.StartFile
+	ReadFile            = protocol.ReadFile
+	WriteFile           = protocol.WriteFile
+	EndFile             = protocol.EndFile
+	Create              = protocol.Create
+	Delete              = protocol.Delete
+	Rename              = protocol.Rename
+	GetSpecialPathCount = protocol.GetSpecialPathCount
+	GetSpecialPath      = protocol.GetSpecialPath
+	SelectFile          = protocol.SelectFile
 )
 
 type command struct {
-	cmdMap map[ID]func()
+	ctx    context.Context
+	cmdMap map[ID]HandlerFunc
+	files  *handles
+
+	// Goldleaf's description and version.
+	desc   string
+	serial string
+
+	// Folders of the profile matching the connected console.
+	folders []cfg.Folder
+	// Picks the profile to serve, see Options.Folders.
+	profiles func(serial string, product string) (string, []cfg.Folder)
+	// Returns the filesystem backing a folder, see Options.Mount.
+	mount func(f cfg.Folder) fsUtil.FS
+	// Filesystem of each folder.
+	mounts []fsUtil.FS
+	// Confines Goldleaf's paths to the folders.
+	sandbox *sandbox.Sandbox
+	// Where each folder's deletions go.
+	trashes []*trash.Trash
+	// Trash directories inside the folders, kept away from Goldleaf.
+	hidden []string
+	// Reports whether changes are refused, see Manager.SetReadOnly.
+	readOnly func() bool
+	// Set when the connected Goldleaf isn't supported, every command fails with it.
+	refused error
+	// Allocated on its own to keep the counters 64-bit aligned.
+	stats *Stats
 	*buffer
 }
 
-func New(ctx context.Context) (*command, error) {
+// Session serves Goldleaf the commands it sends through a Transport.
+type Session interface {
+	// Serves every client of the transport until there are no more.
+	ProcessUSBPackets()
+	// Returns the counters of the commands served so far.
+	Stats() Stats
+}
+
+// Creates a session that talks to Goldleaf through t,
+// serving the commands of the DefaultRegistry too.
+func NewWithTransport(ctx context.Context, t Transport) Session {
+	return newCommand(ctx, t, DefaultRegistry)
+}
+
+func newCommand(ctx context.Context, t Transport, reg *Registry) *command {
 	c := command{
+		ctx:      ctx,
+		files:    newHandles(),
+		stats:    &Stats{},
+		profiles: cfg.FoldersFor,
+		mount:    func(cfg.Folder) fsUtil.FS { return fsUtil.OS },
+		sandbox:  sandbox.New(),
+		readOnly: func() bool { return false },
 		buffer: &buffer{
-			usb: initDevice(ctx),
+			usb: t,
 		}}
 
 	// Map cmd ID to respective function
-	c.cmdMap = map[ID]func(){
-		Invalid:             func() { log.Printf("usbUtils.Invalid:") },
+	c.cmdMap = reg.build(map[ID]HandlerFunc{
+		Invalid:             c.invalid,
 		GetDriveCount:       c.getDriveCount,
 		GetDriveInfo:        c.getDriveInfo,
 		StatPath:            c.statPath,
@@ -88,76 +143,181 @@ func New(ctx context.Context) (*command, error) {
 		GetSpecialPathCount: c.getSpecialPathCount,
 		GetSpecialPath:      c.getSpecialPath,
 		SelectFile:          c.selectFile,
-	}
+	})
 
-	return &c, nil
+	return &c
+}
+
+// Returns the counters of the commands served so far.
+func (c *command) Stats() Stats {
+	return c.stats.snapshot()
 }
 
 func (c *command) ProcessUSBPackets() {
 
 	// Loop waiting for device, improve by using recover someway
 	for {
-		// Check if device is connected.
-		b := c.usb.isConnected()
-
 		// Waits for device to appear
 		// If false, returns.
-		if !<-b {
+		if !c.usb.Connect() {
 			return
 		}
 
-		//quarkVersion := "0.4.0"
-		//minGoldleafVersion := "0.8.0"
-
 		// Reads goldleaf description
 		d, err := c.retrieveDesc()
 		if err != nil {
-			log.Fatalf("ERROR: %v", err)
+			log.Printf("ERROR: Couldn't read device description. %v", err)
+			c.usb.Close()
+			continue
 		}
 
 		// Reads goldleaf's version number
 		s, err := c.retrieveSerialNumber()
 		if err != nil {
-			log.Fatalf("ERROR: %v", err)
+			log.Printf("ERROR: Couldn't read device serial number. %v", err)
+			c.usb.Close()
+			continue
 		}
 
 		fmt.Printf(header, d, s)
+		c.desc, c.serial = d, s
 
-		// Loop for reading usb
-		for {
-			if err := c.readFromUSB(); err != nil {
-				// When usb is disconnected don't panic.
-				// I need to tell the program to wait for a device again.
-				log.Printf("INFO: Lost connection to device. %v", err)
-				log.Println("Exiting loop...")
-				c.usb.Close()
-				break
-			}
+		// Don't serve a protocol Goldleaf doesn't speak, tell it why instead.
+		_, c.refused = CheckVersion(s)
+		if c.refused != nil {
+			log.Printf("ERROR: Refusing %v. %v", d, c.refused)
+		}
 
-			// Magic [:4]
-			i, err := c.readInt32()
-			if err != nil {
-				log.Fatalf("ERROR: %v", err)
-			}
+		profile, folders := c.profiles(s, d)
+		log.Printf("INFO: Serving profile %v to %v %v", profile, d, s)
+		c.serveFolders(folders)
+		c.purgeTrash(cfg.TrashRetention())
 
-			if i != GLCI {
-				log.Fatalf("ERROR: Invalid magic GLCI, got %v", i)
-			}
+		err = c.serve()
+		if errors.Is(err, ErrDeviceLost) {
+			log.Printf("INFO: Device lost. %v", err)
+		}
 
-			// CMD [4:]
-			cmd, err := c.readInt32()
-			if err != nil {
-				log.Fatalln(err)
-			}
+		st := c.Stats()
+		log.Printf("INFO: Served %v commands, %v failed, %v unsupported", st.Commands, st.Failed, st.Unsupported)
+	}
+}
 
-			// Invoke requested function
-			c.cmdMap[ID(cmd)]()
+// Handles commands until the connection is lost.
+// Files opened by Goldleaf don't outlive the session nor the context.
+func (c *command) serve() error {
+	done := make(chan struct{})
+	defer close(done)
+	defer c.files.closeAll()
+
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			c.files.closeAll()
+		case <-done:
+		}
+	}()
+
+	// Loop for reading usb
+	for {
+		if err := c.handleCommand(); err != nil {
+			// When usb is disconnected don't panic.
+			// I need to tell the program to wait for a device again.
+			log.Printf("INFO: Lost connection to device. %v", err)
+			log.Println("Exiting loop...")
+			c.usb.Close()
+			return err
 		}
 	}
 }
 
+// Reads a command from Goldleaf and invokes its handler.
+// Failed requests are reported back to Goldleaf, only transport errors are returned.
+func (c *command) handleCommand() error {
+	if err := c.readFromUSB(); err != nil {
+		return err
+	}
+
+	// Magic [:4]
+	i, err := c.readInt32()
+	if err != nil {
+		return err
+	}
+
+	if i != GLCI {
+		log.Printf("ERROR: Invalid magic GLCI, got %v", i)
+		return c.respondFailure(result.InvalidCommand)
+	}
+
+	// CMD [4:]
+	cmd, err := c.readInt32()
+	if err != nil {
+		return err
+	}
+	c.stats.add(&c.stats.Commands)
+
+	if c.refused != nil {
+		c.stats.add(&c.stats.Failed)
+		log.Printf("ERROR: Command %v refused. %v", cmd, c.refused)
+		if ID(cmd) == WriteFile {
+			var r protocol.WriteFileRequest
+			if err := c.skipWrite(&r, r.Decode(c.in)); err != nil {
+				return err
+			}
+		}
+		return c.respondFailure(result.FromError(c.refused))
+	}
+
+	// Newer Goldleaf may send commands we don't know about.
+	handler, ok := c.cmdMap[ID(cmd)]
+	if !ok {
+		c.stats.add(&c.stats.Unsupported)
+		log.Printf("ERROR: Unsupported command %v, payload %x", ID(cmd), payloadPreview(c.in.Remaining()))
+		return c.respondFailure(result.UnsupportedCommand)
+	}
+
+	// Invoke requested function
+	req := &Request{
+		ID:          ID(cmd),
+		Description: c.desc,
+		Serial:      c.serial,
+		buf:         c.buffer,
+	}
+	resp, err := handler(c.ctx, req)
+	if err == nil {
+		err = c.respond(resp)
+	}
+	if err == nil || isTransportError(err) {
+		return err
+	}
+
+	c.stats.add(&c.stats.Failed)
+	r := result.FromError(err)
+	log.Printf("ERROR: %v (%v)", err, r)
+	return c.respondFailure(r)
+}
+
+// Skips the data following a WriteFile that won't be written, decoded as r
+// with err, so the next block read is a command again. Without a size to skip,
+// a negative one or an undecodable request, the session is out of sync and ends.
+func (c *command) skipWrite(r *protocol.WriteFileRequest, err error) error {
+	if err != nil && !errors.Is(err, protocol.ErrWriteTooLarge) {
+		return &transportError{fmt.Errorf("%w: %v", ErrOutOfSync, err)}
+	}
+	return c.skipRaw(r.Size)
+}
+
+// Trailing padding is dropped and long payloads cut, they're only logged.
+func payloadPreview(p []byte) []byte {
+	p = bytes.TrimRight(p, "\x00")
+	if len(p) > 64 {
+		p = p[:64]
+	}
+	return p
+}
+
 func (c *command) retrieveDesc() (string, error) {
-	s, err := c.usb.getDescription()
+	s, err := c.usb.Description()
 	if err != nil {
 		return "", err
 	}
@@ -165,469 +325,562 @@ func (c *command) retrieveDesc() (string, error) {
 }
 
 func (c *command) retrieveSerialNumber() (string, error) {
-	s, err := c.usb.getSerialNumber()
+	s, err := c.usb.SerialNumber()
 	if err != nil {
 		return "", err
 	}
 	return s, nil
 }
 
-func (c *command) getDriveCount() {
+func (c *command) invalid(ctx context.Context, req *Request) (*Response, error) {
+	log.Printf("usbUtils.Invalid:")
+	return nil, nil
+}
+
+func (c *command) getDriveCount(ctx context.Context, req *Request) (*Response, error) {
 	log.Println("GetDriveCount")
 	drives, err := fsUtil.ListDrives()
 	if err != nil {
-		log.Fatalf("ERROR: %v", err)
+		return nil, fmt.Errorf("couldn't list drives. %w", err)
 	}
 
-	c.responseStart()
-	c.writeInt32(uint32(len(drives)))
-	c.responseEnd()
+	return Reply(&protocol.GetDriveCountResponse{Count: uint32(len(drives))}), nil
 }
 
-func (c *command) getDriveInfo() {
+func (c *command) getDriveInfo(ctx context.Context, req *Request) (*Response, error) {
 	log.Println("GetDriveInfo")
 	drives, err := fsUtil.ListDrives()
 	if err != nil {
-		log.Fatalf("ERROR: %v", err)
+		return nil, fmt.Errorf("couldn't list drives. %w", err)
 	}
 
-	// Read payload
-	idx, err := c.readInt32()
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't retrieve next int32 %v", err)
+	var r protocol.GetDriveInfoRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
 	}
 
-	if int(idx) > len(drives) || int(idx) <= -1 {
-		c.respondFailure(0xDEAD)
-		log.Fatalf("ERROR: Invalid disk index %v", idx)
+	idx := int(r.Index)
+	if idx >= len(drives) || idx < 0 {
+		return nil, fmt.Errorf("%w: disk %v", result.ErrInvalidIndex, idx)
 	}
 
 	drive := drives[idx]
 	label, err := fsUtil.GetDriveLabel(drive)
 	if err != nil {
-		log.Fatalf("ERROR: Can't get drive label for %v", drive)
+		return nil, fmt.Errorf("can't get drive label for %v. %w", drive, err)
 	}
 
-	c.responseStart()
-	c.writeString(label)
-	c.writeString(drive)
-	c.writeInt32(0)
-	c.writeInt32(0)
-	c.responseEnd()
+	return Reply(&protocol.GetDriveInfoResponse{Label: label, Prefix: drive}), nil
 }
 
-func (c *command) getSpecialPath() {
+func (c *command) getSpecialPath(ctx context.Context, req *Request) (*Response, error) {
 	log.Println("GetSpecialPath")
 
-	// Read payload
-	idx, err := c.readInt32()
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't retrieve next int32 %v", err)
+	var r protocol.GetSpecialPathRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
 	}
 
-	if int(idx) > int(cfg.Size()) || int(idx) <= -1 {
-		c.respondFailure(0xDEAD)
-		log.Fatalf("ERROR: Invalid path index %v", idx)
+	idx := int(r.Index)
+	if idx >= len(c.folders) || idx < 0 {
+		return nil, fmt.Errorf("%w: path %v", result.ErrInvalidIndex, idx)
 	}
+	folder := c.folders[idx]
 
-	folders := cfg.ListFolders()
-	folder := folders[idx]
-
-	c.responseStart()
-	c.writeString(folder.Alias)
-	c.writeString(fsUtil.NormalizePath(folder.Path))
-	c.responseEnd()
+	return Reply(&protocol.GetSpecialPathResponse{
+		Name: folder.Alias,
+		Path: fsUtil.NormalizePath(folder.Path),
+	}), nil
 }
 
-func (c *command) getSpecialPathCount() {
+func (c *command) getSpecialPathCount(ctx context.Context, req *Request) (*Response, error) {
 	log.Println("GetSpecialPathCount")
-	c.responseStart()
-	c.writeInt32(cfg.Size())
-	c.responseEnd()
+	return Reply(&protocol.GetSpecialPathCountResponse{Count: uint32(len(c.folders))}), nil
 }
 
-func (c *command) getDirectoryCount() {
+func (c *command) getDirectoryCount(ctx context.Context, req *Request) (*Response, error) {
 	log.Println("GetDirectoryCount")
-	s, err := c.readString()
+	var r protocol.GetDirectoryCountRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
+	}
+	path, err := c.resolve(r.Path)
 	if err != nil {
-		log.Fatalf("ERROR: Can't send directory count for %v", err)
+		return nil, err
 	}
-	path := fsUtil.DenormalizePath(s)
-	count, err := fsUtil.GetDirectoriesIn(path)
+	dirs, err := c.directoriesIn(path)
 	if err != nil {
-		log.Fatalf("ERROR: Can't get directories inside path %v", err)
+		return nil, fmt.Errorf("can't get directories inside %v. %w", path, err)
 	}
-	c.responseStart()
-	c.writeInt32(uint32(len(count)))
-	c.responseEnd()
+	return Reply(&protocol.GetDirectoryCountResponse{Count: uint32(len(dirs))}), nil
 }
 
-func (c *command) selectFile() {
+func (c *command) selectFile(ctx context.Context, req *Request) (*Response, error) {
 	log.Println("SelectFile")
 	path := fsUtil.NormalizePath("/Users/wuff/Documents/quarkgo")
-	c.responseStart()
-	c.writeString(path)
-	c.responseEnd()
+	return Reply(&protocol.SelectFileResponse{Path: path}), nil
 }
 
-func (c *command) statPath() {
+func (c *command) statPath(ctx context.Context, req *Request) (*Response, error) {
 	log.Println("StatPath")
-	path, err := c.readString()
-	if err != nil {
-		log.Fatalf("ERROR: Can't read string from buffer. %v", err)
-		return
+	var r protocol.StatPathRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
 	}
 
-	path = fsUtil.DenormalizePath(path)
-	fi, err := os.Stat(path)
+	path, err := c.resolve(r.Path)
 	if err != nil {
-		log.Printf("ERROR: Couldn't get %v stats. %v", path, err)
-		c.respondFailure(0xDEAD)
-		return
+		return nil, err
 	}
-
-	ftype := 0
-	var fsize int64 = 0
-
-	if !fi.IsDir() {
-		ftype = 1
-		fsize = fi.Size()
+	fi, err := c.fsFor(path).Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get %v stats. %w", path, err)
 	}
+
+	resp := protocol.StatPathResponse{Type: protocol.TypeFile}
 	if fi.IsDir() {
-		ftype = 2
-	}
-	if ftype == 0 {
-		c.respondFailure(0xDEAD)
-		return
+		resp.Type = protocol.TypeDirectory
+	} else {
+		resp.Size = uint64(fi.Size())
 	}
 
-	c.responseStart()
-	c.writeInt32(uint32(ftype))
-	c.writeInt64(uint64(fsize))
-	c.responseEnd()
+	return Reply(&resp), nil
 }
 
-func (c *command) getFileCount() {
+func (c *command) getFileCount(ctx context.Context, req *Request) (*Response, error) {
 	log.Println("GetFileCount")
-	path, err := c.readString()
+	var r protocol.GetFileCountRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
+	}
+	path, err := c.resolve(r.Path)
 	if err != nil {
-		log.Fatalf("ERROR: Can't read string from buffer. %v", err)
-		return
+		return nil, err
 	}
-	path = fsUtil.DenormalizePath(path)
-	nFiles, err := fsUtil.GetFilesIn(path)
+	nFiles, err := fsUtil.GetFilesIn(c.fsFor(path), path)
 	if err != nil {
-		log.Fatalf("ERROR: Can't get files in %v. %v", path, err)
-		return
+		return nil, fmt.Errorf("can't get files in %v. %w", path, err)
 	}
 
-	c.responseStart()
-	c.writeInt32(uint32(len(nFiles)))
-	c.responseEnd()
+	return Reply(&protocol.GetFileCountResponse{Count: uint32(len(nFiles))}), nil
 }
 
-func (c *command) getFile() {
+func (c *command) getFile(ctx context.Context, req *Request) (*Response, error) {
 	log.Println("GetFile")
-	path, err := c.readString()
-	if err != nil {
-		log.Fatalf("ERROR: Can't read string from buffer. %v", err)
-		return
+	var r protocol.GetFileRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
 	}
-	// idx comes after the path
-	idx, err := c.readInt32()
+
+	path, err := c.resolve(r.Path)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't retrieve next int32 %v", err)
+		return nil, err
 	}
-
-	path = fsUtil.DenormalizePath(path)
-	files, err := fsUtil.GetFilesIn(path)
+	files, err := fsUtil.GetFilesIn(c.fsFor(path), path)
 	if err != nil {
-		log.Fatalf("ERROR: Can't get files in %v. %v", path, err)
-		return
+		return nil, fmt.Errorf("can't get files in %v. %w", path, err)
 	}
 
+	idx := int(r.Index)
 	if idx >= len(files) || idx < 0 {
-		c.respondFailure(0xDEAD)
-		return
+		return nil, fmt.Errorf("%w: file %v in %v", result.ErrInvalidIndex, idx, path)
 	}
 
-	c.responseStart()
-	c.writeString(files[idx])
-	c.responseEnd()
+	return Reply(&protocol.GetFileResponse{Name: files[idx]}), nil
 }
 
-func (c *command) getDirectory() {
+func (c *command) getDirectory(ctx context.Context, req *Request) (*Response, error) {
 	log.Println("GetDirectory")
-	path, err := c.readString()
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't read string from buffer. %v", err)
+	var r protocol.GetDirectoryRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
 	}
-	path = fsUtil.DenormalizePath(path)
-
-	idx, err := c.readInt32()
+	path, err := c.resolve(r.Path)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't read int32 from buffer. %v", err)
+		return nil, err
 	}
 
-	dirs, err := fsUtil.GetDirectoriesIn(path)
+	dirs, err := c.directoriesIn(path)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't get directories in %v. %v", path, err)
+		return nil, fmt.Errorf("couldn't get directories in %v. %w", path, err)
 	}
 
-	if idx > len(dirs) || idx < 0 {
-		c.respondFailure(0xDEAD)
+	idx := int(r.Index)
+	if idx >= len(dirs) || idx < 0 {
+		return nil, fmt.Errorf("%w: directory %v in %v", result.ErrInvalidIndex, idx, path)
 	}
 
-	c.responseStart()
-	c.writeString(dirs[idx])
-	c.responseEnd()
+	return Reply(&protocol.GetDirectoryResponse{Name: dirs[idx]}), nil
 }
 
-// TODO: Follow "The happy path is left-aligned"
-func (c *command) readFile() {
+func (c *command) readFile(ctx context.Context, req *Request) (*Response, error) {
 	log.Println("ReadFile")
-	path, err := c.readString()
+	var r protocol.ReadFileRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
+	}
+	path, err := c.resolve(r.Path)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't read string from buffer. %v", err)
+		return nil, err
+	}
+	if err := c.allow(path, cfg.OpRead); err != nil {
+		return nil, err
 	}
-	path = fsUtil.DenormalizePath(path)
+	offset, size := r.Offset, r.Size
 
-	offset, err := c.readInt64()
+	if offset < 0 || size < 0 {
+		return nil, fmt.Errorf("%w: offset %v size %v for %v", result.ErrInvalidRange, offset, size, path)
+	}
+
+	oneShot := false
+	file, err := c.files.get(path, accessRead)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't read int32 from buffer. %v", err)
+		// Goldleaf may read without calling StartFile first.
+		file, err = c.fsFor(path).Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't open %v. %w", path, err)
+		}
+		oneShot = true
 	}
 
-	size, err := c.readInt64()
+	fi, err := file.Stat()
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't read int32 from buffer. %v", err)
+		if oneShot {
+			file.Close()
+		}
+		return nil, fmt.Errorf("couldn't get %v stats. %w", path, err)
 	}
 
-	var file *os.File
+	// Goldleaf may ask past the end of the file, only send what's there.
+	bRead := fi.Size() - offset
+	if bRead < 0 {
+		bRead = 0
+	}
+	if bRead > size {
+		bRead = size
+	}
 
-	if fileReader != nil {
-		// Use the already opened fileReader
-		file = fileReader
-	} else {
-		// Or Don't use it for some reason..
-		file, err = os.Open(path)
+	resp := Reply(&protocol.ReadFileResponse{Size: bRead})
+	return resp.Stream(func(write func([]byte) error) error {
+		if oneShot {
+			defer file.Close()
+		}
+		return streamFile(write, file, offset, bRead)
+	}), nil
+}
+
+// Turns a Goldleaf path into a local one, failing unless it's
+// inside the served folders, their trash excluded.
+func (c *command) resolve(p string) (string, error) {
+	path := fsUtil.DenormalizePath(p)
+	// Goldleaf only sends absolute paths, like Home:/dir.
+	if !filepath.IsAbs(path) || strings.ContainsRune(path, 0) {
+		return "", fmt.Errorf("%w: %q", result.ErrInvalidPath, p)
+	}
+	path, err := c.sandbox.Resolve(path)
+	if err != nil {
+		return "", err
+	}
+	for _, h := range c.hidden {
+		if sandbox.Within(h, path) {
+			return "", fmt.Errorf("%w: %v is in the trash", sandbox.ErrOutside, p)
+		}
+	}
+	return path, nil
+}
+
+// Sets up the sandbox and trash of the folders to serve.
+func (c *command) serveFolders(folders []cfg.Folder) {
+	c.folders = folders
+	c.mounts = make([]fsUtil.FS, len(folders))
+	roots := make([]sandbox.Root, len(folders))
+	for i, f := range folders {
+		c.mounts[i] = c.mount(f)
+		roots[i] = sandbox.Root{Path: f.Path, FS: c.mounts[i]}
+	}
+	c.sandbox = sandbox.NewRoots(roots...)
+
+	c.trashes = make([]*trash.Trash, len(folders))
+	c.hidden = nil
+	for i, f := range folders {
+		dir, err := filepath.Abs(f.TrashDir())
 		if err != nil {
-			log.Fatalf("ERROR: Couldn't open %v. %v", path, err)
+			dir = f.TrashDir()
+		}
+		c.trashes[i] = trash.New(c.mounts[i], dir)
+		// Trash kept outside the folders is already out of reach.
+		if real, err := c.sandbox.Resolve(dir); err == nil {
+			c.hidden = append(c.hidden, real)
 		}
 	}
+}
 
-	_, err = file.Seek(offset, 0)
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't seek %v to offset %v. %v", path, offset, err)
+// Removes for good what was deleted longer than retention ago.
+func (c *command) purgeTrash(retention time.Duration) {
+	if retention <= 0 {
+		return
 	}
+	for _, t := range c.trashes {
+		n, err := t.Purge(time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("ERROR: Couldn't empty trash %v. %v", t.Dir(), err)
+		}
+		if n > 0 {
+			log.Printf("INFO: Removed %v items older than %v from %v", n, retention, t.Dir())
+		}
+	}
+}
 
-	fbuffer := make([]byte, size)
-	bRead, err := file.Read(fbuffer)
+// Lists the directories in path, leaving the trash out.
+func (c *command) directoriesIn(path string) ([]string, error) {
+	dirs, err := fsUtil.GetDirectoriesIn(c.fsFor(path), path)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't read %v. %v", path, err)
+		return nil, err
 	}
+	shown := dirs[:0]
+	for _, d := range dirs {
+		if !c.isHidden(filepath.Join(path, d)) {
+			shown = append(shown, d)
+		}
+	}
+	return shown, nil
+}
 
-	c.responseStart()
-	c.writeInt64(uint64(bRead))
-	c.responseEnd()
+// Returns the filesystem of the folder holding path, as returned by resolve.
+func (c *command) fsFor(path string) fsUtil.FS {
+	if i, ok := c.sandbox.Root(path); ok {
+		return c.mounts[i]
+	}
+	// Not reachable through resolve, fail like a missing folder would.
+	return fsUtil.NewMemFS()
+}
+
+// Reports whether a and b are the same backend.
+// Backends that can't be compared never are.
+func sameFS(a fsUtil.FS, b fsUtil.FS) bool {
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
 
-	if _, err = c.usb.Write(fbuffer); err != nil {
-		log.Fatalf("ERROR: Couldn't write %v.", err)
+func (c *command) isHidden(path string) bool {
+	for _, h := range c.hidden {
+		if path == h {
+			return true
+		}
 	}
+	return false
 }
 
-func (c *command) rename() {
-	fType, err := c.readInt32()
+// Like resolve, but the served folders themselves aren't allowed.
+// Used to keep Goldleaf from deleting or renaming them.
+func (c *command) resolveChild(p string) (string, error) {
+	path, err := c.resolve(p)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't read int32 from buffer. %v", err)
+		return "", err
 	}
+	if c.sandbox.IsRoot(path) {
+		return "", fmt.Errorf("%w: %v is a served folder", sandbox.ErrOutside, p)
+	}
+	return path, nil
+}
 
-	path, err := c.readString()
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't read string from buffer. %v", err)
+// Fails unless the folder holding path, as returned by resolve, allows op.
+// Only reading is allowed in read-only mode.
+func (c *command) allow(path string, op cfg.Op) error {
+	if op != cfg.OpRead && c.readOnly() {
+		return fmt.Errorf("%w: %v %v in read-only mode", result.ErrNotPermitted, op, path)
+	}
+	i, ok := c.sandbox.Root(path)
+	if !ok {
+		return fmt.Errorf("%w: %v", sandbox.ErrOutside, path)
+	}
+	if f := c.folders[i]; !f.Access().Allows(op) {
+		return fmt.Errorf("%w: %v %v in %v", result.ErrNotPermitted, op, path, f.Alias)
 	}
-	path = fsUtil.DenormalizePath(path)
+	return nil
+}
 
-	newPath, err := c.readString()
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't read string from buffer. %v", err)
+// Checks the permissions needed to open path in mode. Writing a file
+// that doesn't exist yet creates it.
+func (c *command) allowMode(path string, mode int) error {
+	if mode == fileModeRead {
+		return c.allow(path, cfg.OpRead)
+	}
+	if err := c.allow(path, cfg.OpWrite); err != nil {
+		return err
 	}
-	newPath = fsUtil.DenormalizePath(newPath)
+	if _, err := c.fsFor(path).Stat(path); os.IsNotExist(err) {
+		return c.allow(path, cfg.OpCreate)
+	}
+	return nil
+}
 
-	if fType != 1 && fType != 2 {
-		c.respondFailure(0xDEAD)
+// Goldleaf only renames, deletes and creates files or directories.
+func checkType(t uint32, op string) error {
+	if t != protocol.TypeFile && t != protocol.TypeDirectory {
+		return fmt.Errorf("%w: %v for %v", result.ErrInvalidType, t, op)
 	}
+	return nil
+}
 
-	err = os.Rename(path, newPath)
+func (c *command) rename(ctx context.Context, req *Request) (*Response, error) {
+	var r protocol.RenameRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
+	}
+	path, err := c.resolveChild(r.Path)
+	if err != nil {
+		return nil, err
+	}
+	newPath, err := c.resolveChild(r.NewPath)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't rename %v to %v. %v", path, newPath, err)
+		return nil, err
+	}
+	// Both folders must allow it, moving between them included.
+	if err := c.allow(path, cfg.OpRename); err != nil {
+		return nil, err
+	}
+	if err := c.allow(newPath, cfg.OpRename); err != nil {
+		return nil, err
 	}
 
-	c.respondEmpty()
-}
+	if err := checkType(r.Type, "rename"); err != nil {
+		return nil, err
+	}
 
-func (c *command) delete() {
-	fType, err := c.readInt32()
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't read int32 from buffer. %v", err)
+	fsys := c.fsFor(path)
+	if !sameFS(fsys, c.fsFor(newPath)) {
+		err := &os.LinkError{Op: "rename", Old: path, New: newPath, Err: syscall.EXDEV}
+		return nil, fmt.Errorf("couldn't rename %v to %v, they are in different filesystems. %w", path, newPath, err)
 	}
+	if err := fsys.Rename(path, newPath); err != nil {
+		return nil, fmt.Errorf("couldn't rename %v to %v. %w", path, newPath, err)
+	}
+
+	return Reply(&protocol.RenameResponse{}), nil
+}
 
-	path, err := c.readString()
+func (c *command) delete(ctx context.Context, req *Request) (*Response, error) {
+	var r protocol.DeleteRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
+	}
+	path, err := c.resolveChild(r.Path)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't read string from buffer. %v", err)
+		return nil, err
+	}
+	if err := c.allow(path, cfg.OpDelete); err != nil {
+		return nil, err
 	}
-	path = fsUtil.DenormalizePath(path)
 
-	if fType != 1 && fType != 2 {
-		c.respondFailure(0xDEAD)
+	if err := checkType(r.Type, "delete"); err != nil {
+		return nil, err
 	}
 
-	err = os.RemoveAll(path)
+	// Nothing is removed for good, it can be restored from the trash.
+	i, _ := c.sandbox.Root(path)
+	e, err := c.trashes[i].Put(path, c.serial)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't removeAll %v. %v", path, err)
+		return nil, err
 	}
+	log.Printf("INFO: Moved %v to the trash as %v", path, e.ID)
 
-	c.respondEmpty()
+	return Reply(&protocol.DeleteResponse{}), nil
 }
 
-// TODO: Follow "The happy path is left-aligned"
-func (c *command) create() {
-	// 1 = file, 2 = dir
-	fType, err := c.readInt32()
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't read int32 from buffer. %v", err)
+func (c *command) create(ctx context.Context, req *Request) (*Response, error) {
+	var r protocol.CreateRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
 	}
-
-	path, err := c.readString()
+	path, err := c.resolve(r.Path)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't read string from buffer. %v", err)
+		return nil, err
+	}
+	if err := c.allow(path, cfg.OpCreate); err != nil {
+		return nil, err
 	}
-	path = fsUtil.DenormalizePath(path)
 
-	if fType != 1 && fType != 2 {
-		c.respondFailure(0xDEAD)
+	if err := checkType(r.Type, "create"); err != nil {
+		return nil, err
 	}
 
-	// 1 = file, 2 = dir
-	if fType == 1 {
-		_, err := os.Create(path)
+	fsys := c.fsFor(path)
+	if r.Type == protocol.TypeFile {
+		// Creating must not empty a file, that takes write access.
+		f, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 		if err != nil {
-			log.Fatalf("ERROR: Couldn't create file %v. %v", path, err)
-			c.respondFailure(0xDEAD)
-			return
-		}
-	} else if fType == 2 {
-		err := os.Mkdir(path, 0755)
-		if err != nil {
-			log.Fatalf("ERROR: Couldn't create file %v. %v", path, err)
-			c.respondFailure(0xDEAD)
-			return
+			return nil, fmt.Errorf("couldn't create file %v. %w", path, err)
 		}
+		f.Close()
+	} else if err := fsys.Mkdir(path, 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create directory %v. %w", path, err)
 	}
 
-	c.respondEmpty()
+	return Reply(&protocol.CreateResponse{}), nil
 }
 
-// TODO: Follow "The happy path is left-aligned"
-func (c *command) endFile() {
-	fMode, err := c.readInt32()
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't read int32 from buffer. %v", err)
+func (c *command) endFile(ctx context.Context, req *Request) (*Response, error) {
+	var r protocol.EndFileRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
 	}
 
-	if fMode == 1 {
-		if fileReader != nil {
-			fileReader.Close()
-			fileReader = nil
-		}
-	} else {
-		if fileWriter != nil {
-			fileWriter.Close()
-			fileWriter = nil
-		}
-	}
-	c.respondEmpty()
+	c.files.closeAccess(accessFor(int(r.Mode)))
+	return Reply(&protocol.EndFileResponse{}), nil
 }
 
-// TODO: Follow "The happy path is left-aligned"
-func (c *command) startFile() {
-	path, err := c.readString()
+func (c *command) startFile(ctx context.Context, req *Request) (*Response, error) {
+	var r protocol.StartFileRequest
+	if err := req.Decode(&r); err != nil {
+		return nil, err
+	}
+	path, err := c.resolve(r.Path)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't read string from buffer. %v", err)
+		return nil, err
+	}
+	if err := c.allowMode(path, int(r.Mode)); err != nil {
+		return nil, err
 	}
-	path = fsUtil.DenormalizePath(path)
 
-	fMode, err := c.readInt32()
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't read int32 from buffer. %v", err)
+	if err := c.files.open(c.fsFor(path), path, int(r.Mode)); err != nil {
+		return nil, fmt.Errorf("couldn't open %v. %w", path, err)
 	}
 
-	if fMode == 1 {
-		if fileReader != nil {
-			fileReader.Close()
-		}
-		// Open Read Only
-		fileReader, err = os.Open(path)
-		if err != nil {
-			log.Fatalf("ERROR: Couldn't open %v. %v", path, err)
-		}
-	} else {
-		if fileWriter != nil {
-			fileWriter.Close()
-		}
-		//Open Read and Write
-		fileWriter, err = os.Create(path)
-		if err != nil {
-			log.Fatalf("ERROR: Couldn't write %v. %v", path, err)
-		}
+	return Reply(&protocol.StartFileResponse{}), nil
+}
 
-		if fMode == 3 {
-			fInfo, err := fileWriter.Stat()
-			if err != nil {
-				log.Fatalf("ERROR: Couldn't get stats for %v. %v", path, err)
-			}
-			_, err = fileWriter.Seek(fInfo.Size(), 0)
-			if err != nil {
-				log.Fatalf("ERROR: Couldn't get stats for %v. %v", path, err)
-			}
+func (c *command) writeFile(ctx context.Context, req *Request) (*Response, error) {
+	var r protocol.WriteFileRequest
+	if err := req.Decode(&r); err != nil {
+		// Its data follows all the same.
+		if serr := c.skipWrite(&r, err); serr != nil {
+			return nil, serr
 		}
+		return nil, err
 	}
 
-	c.respondEmpty()
-}
-
-// TODO: Follow "The happy path is left-aligned"
-func (c *command) writeFile() {
-	path, err := c.readString()
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't read string from buffer. %v", err)
+	// The data follows the request, it's read even if refused to stay in sync.
+	buffer := make([]byte, r.Size)
+	if err := req.ReadRaw(buffer); err != nil {
+		return nil, err
 	}
-	path = fsUtil.DenormalizePath(path)
 
-	bLenght, err := c.readInt64()
+	path, err := c.resolve(r.Path)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't read int32 from buffer. %v", err)
+		return nil, err
+	}
+	if err := c.allow(path, cfg.OpWrite); err != nil {
+		return nil, err
 	}
 
-	buffer := make([]byte, bLenght)
-	_, err = c.usb.Read(buffer)
+	file, err := c.files.get(path, accessWrite)
 	if err != nil {
-		log.Fatalf("ERROR: Couldn't read directly from buffer. %v", err)
+		return nil, err
 	}
 
-	if fileWriter != nil {
-		_, err := fileWriter.Write(buffer)
-		if err != nil {
-			log.Fatalf("ERROR: Couldn't write %v to disk. %v", path, err)
-			c.respondFailure(0xDEAD)
-			return
-		}
-		c.respondEmpty()
-		return
-	}
-	err = os.WriteFile(path, buffer, os.ModeAppend)
-	if err != nil {
-		c.respondFailure(0xDEAD)
-		return
+	if err := appendChunk(file, buffer); err != nil {
+		return nil, fmt.Errorf("couldn't write %v to disk. %w", path, err)
 	}
-	c.respondEmpty()
+	return Reply(&protocol.WriteFileResponse{}), nil
 }
@@ -0,0 +1,1083 @@
+package usb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/cfg"
+	fsUtil "github.com/bitrvmpd/goquark/internal/pkg/fs"
+	"github.com/bitrvmpd/goquark/internal/pkg/goldleaf"
+	"github.com/bitrvmpd/goquark/internal/pkg/protocol"
+	"github.com/bitrvmpd/goquark/internal/pkg/result"
+	"github.com/bitrvmpd/goquark/internal/pkg/trash"
+)
+
+// How newTestSession serves its client.
+type testSession struct {
+	version string
+	folders []cfg.Folder
+	reg     *Registry
+	wrap    func(t Transport) Transport
+	setup   []func(c *command)
+}
+
+type sessionOption func(s *testSession)
+
+// Has the client report version as serial number.
+func withVersion(version string) sessionOption {
+	return func(s *testSession) { s.version = version }
+}
+
+// Serves folders instead of the test ones.
+func withFolders(folders ...cfg.Folder) sessionOption {
+	return func(s *testSession) { s.folders = folders }
+}
+
+// Serves the handlers and middleware of reg instead of the default ones.
+func withRegistry(reg *Registry) sessionOption {
+	return func(s *testSession) { s.reg = reg }
+}
+
+// Serves the client through what wrap makes of the in-memory link.
+func withTransport(wrap func(t Transport) Transport) sessionOption {
+	return func(s *testSession) { s.wrap = wrap }
+}
+
+// Tweaks the command before it starts serving.
+func withSetup(setup func(c *command)) sessionOption {
+	return func(s *testSession) { s.setup = append(s.setup, setup) }
+}
+
+// Folders served to test clients. The temporary directory holds every test tree,
+// each test gets a trash of its own.
+func testFolders(t testing.TB) []cfg.Folder {
+	return []cfg.Folder{{Alias: "Temp", Path: os.TempDir(), Trash: t.TempDir()}}
+}
+
+// Starts a session served through an in-memory link. Returns the command
+// serving it, the emulated Goldleaf client connected to it and a channel
+// closed once it stops.
+func newTestSession(t testing.TB, opts ...sessionOption) (*command, *goldleaf.Client, chan struct{}) {
+	t.Helper()
+	s := testSession{
+		version: "0.10.0",
+		folders: testFolders(t),
+		reg:     DefaultRegistry,
+		wrap:    func(t Transport) Transport { return t },
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+
+	l, client := goldleaf.Pipe("Goldleaf", s.version)
+	c := newCommand(context.Background(), s.wrap(l), s.reg)
+	c.profiles = func(string, string) (string, []cfg.Folder) {
+		return "test", s.folders
+	}
+	for _, setup := range s.setup {
+		setup(c)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.ProcessUSBPackets()
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return c, client, done
+}
+
+// Fails unless err is a failure response carrying code.
+func expectResult(t *testing.T, err error, code result.Code) {
+	t.Helper()
+	var r *goldleaf.ResultError
+	if !errors.As(err, &r) {
+		t.Fatalf("expected result %v, got %v", code, err)
+	}
+	if result.Code(r.Code) != code {
+		t.Fatalf("expected result %v, got %v", code, result.Code(r.Code))
+	}
+}
+
+// Creates a directory with two files and one subdirectory.
+func newTestTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.nsp"), []byte("hello goldleaf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.xci"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestGetDriveCountAndInfo(t *testing.T) {
+	_, client, _ := newTestSession(t)
+
+	n, err := client.GetDriveCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	drives, _ := fsUtil.ListDrives()
+	if n != len(drives) {
+		t.Fatalf("got %v drives, want %v", n, len(drives))
+	}
+	if n == 0 {
+		return
+	}
+
+	label, prefix, err := client.GetDriveInfo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix != drives[0] || label == "" {
+		t.Fatalf("got drive %q (%q), want %q", prefix, label, drives[0])
+	}
+}
+
+func TestStatPath(t *testing.T) {
+	_, client, _ := newTestSession(t)
+	dir := newTestTree(t)
+
+	fType, size, err := client.StatPath(fsUtil.NormalizePath(filepath.Join(dir, "a.nsp")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fType != goldleaf.TypeFile || size != int64(len("hello goldleaf")) {
+		t.Fatalf("got type %v size %v", fType, size)
+	}
+
+	fType, _, err = client.StatPath(fsUtil.NormalizePath(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fType != goldleaf.TypeDirectory {
+		t.Fatalf("got type %v, want directory", fType)
+	}
+
+	if _, _, err := client.StatPath(fsUtil.NormalizePath(filepath.Join(dir, "missing"))); err == nil {
+		t.Fatal("expected failure for a missing path")
+	}
+}
+
+func TestFilesAndDirectories(t *testing.T) {
+	_, client, _ := newTestSession(t)
+	dir := fsUtil.NormalizePath(newTestTree(t))
+
+	n, err := client.GetFileCount(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("got %v files, want 2", n)
+	}
+
+	f, err := client.GetFile(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != "b.xci" {
+		t.Fatalf("got file %q, want b.xci", f)
+	}
+
+	if _, err := client.GetFile(dir, 2); err == nil {
+		t.Fatal("expected failure for an out of range file index")
+	}
+
+	n, err = client.GetDirectoryCount(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("got %v directories, want 1", n)
+	}
+
+	d, err := client.GetDirectory(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != "sub" {
+		t.Fatalf("got directory %q, want sub", d)
+	}
+}
+
+func TestNonASCIINames(t *testing.T) {
+	_, client, _ := newTestSession(t)
+	root := t.TempDir()
+
+	// Japanese, accented and emoji names, the last one needs surrogate pairs.
+	dirName := "ゼルダの伝説 Édition"
+	fileName := "Pokémon 🎮.nsp"
+	if err := os.Mkdir(filepath.Join(root, dirName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, dirName, fileName), []byte("ポケモン"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := client.GetDirectory(fsUtil.NormalizePath(root), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != dirName {
+		t.Fatalf("got directory %q, want %q", d, dirName)
+	}
+
+	dir := fsUtil.NormalizePath(filepath.Join(root, dirName))
+	f, err := client.GetFile(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != fileName {
+		t.Fatalf("got file %q, want %q", f, fileName)
+	}
+
+	// Paths sent by Goldleaf are decoded back to the same file.
+	path := dir + "/" + fileName
+	_, size, err := client.StatPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := client.ReadFile(path, 0, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ポケモン" {
+		t.Fatalf("got %q", data)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	_, client, _ := newTestSession(t)
+	path := fsUtil.NormalizePath(filepath.Join(newTestTree(t), "a.nsp"))
+
+	if err := client.StartFile(path, goldleaf.ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	b, err := client.ReadFile(path, 6, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "goldleaf" {
+		t.Fatalf("got %q, want goldleaf", b)
+	}
+	if err := client.EndFile(goldleaf.ModeRead); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	_, client, _ := newTestSession(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.bin")
+	data := bytes.Repeat([]byte{0xAB}, 3*BlockSize+7)
+
+	if err := client.StartFile(fsUtil.NormalizePath(path), goldleaf.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteFile(fsUtil.NormalizePath(path), data); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EndFile(goldleaf.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("written file differs, got %v bytes want %v", len(b), len(data))
+	}
+}
+
+func TestCreateRenameDelete(t *testing.T) {
+	_, client, _ := newTestSession(t)
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "new.txt")
+	if err := client.Create(goldleaf.TypeFile, fsUtil.NormalizePath(file)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal(err)
+	}
+
+	folder := filepath.Join(dir, "folder")
+	if err := client.Create(goldleaf.TypeDirectory, fsUtil.NormalizePath(folder)); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(folder); err != nil || !fi.IsDir() {
+		t.Fatalf("expected %v to be a directory. %v", folder, err)
+	}
+
+	renamed := filepath.Join(folder, "renamed.txt")
+	if err := client.Rename(goldleaf.TypeFile, fsUtil.NormalizePath(file), fsUtil.NormalizePath(renamed)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(renamed); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Delete(goldleaf.TypeDirectory, fsUtil.NormalizePath(folder)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(folder); !os.IsNotExist(err) {
+		t.Fatalf("expected %v to be deleted. %v", folder, err)
+	}
+}
+
+func TestSpecialPaths(t *testing.T) {
+	_, client, _ := newTestSession(t)
+
+	folders := testFolders(t)
+	n, err := client.GetSpecialPathCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(folders) {
+		t.Fatalf("got %v special paths, want %v", n, len(folders))
+	}
+
+	for i, folder := range folders {
+		name, path, err := client.GetSpecialPath(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != folder.Alias || path != fsUtil.NormalizePath(folder.Path) {
+			t.Fatalf("got %q %q, want %q %q", name, path, folder.Alias, folder.Path)
+		}
+	}
+}
+
+func TestSelectFile(t *testing.T) {
+	_, client, _ := newTestSession(t)
+
+	path, err := client.SelectFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path == "" {
+		t.Fatal("expected a path")
+	}
+}
+
+func TestFailuresKeepSession(t *testing.T) {
+	_, client, _ := newTestSession(t)
+	dir := newTestTree(t)
+	missing := fsUtil.NormalizePath(filepath.Join(dir, "missing"))
+
+	expectResult(t, client.StartFile(missing, goldleaf.ModeRead), result.NotFound)
+
+	_, err := client.GetDirectory(fsUtil.NormalizePath(dir), 5)
+	expectResult(t, err, result.InvalidIndex)
+
+	_, err = client.GetFileCount(missing)
+	expectResult(t, err, result.NotFound)
+
+	expectResult(t, client.Rename(goldleaf.TypeFile, missing, missing+".bak"), result.NotFound)
+	expectResult(t, client.Create(3, missing), result.InvalidType)
+	expectResult(t, client.Create(goldleaf.TypeDirectory, fsUtil.NormalizePath(dir)), result.AlreadyExists)
+
+	// Session must still be alive.
+	if _, err := client.GetFileCount(fsUtil.NormalizePath(dir)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFileUsesRequestedPath(t *testing.T) {
+	_, client, _ := newTestSession(t)
+	dir := newTestTree(t)
+	a := fsUtil.NormalizePath(filepath.Join(dir, "a.nsp"))
+	other := filepath.Join(dir, "other.nsp")
+	if err := ioutil.WriteFile(other, []byte("other file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.StartFile(a, goldleaf.ModeRead); err != nil {
+		t.Fatal(err)
+	}
+
+	// a.nsp is open, but other.nsp is the one requested.
+	b, err := client.ReadFile(fsUtil.NormalizePath(other), 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "other" {
+		t.Fatalf("got %q, want other", b)
+	}
+}
+
+func TestWriteFileRequiresStartFile(t *testing.T) {
+	_, client, _ := newTestSession(t)
+	dir := t.TempDir()
+	path := fsUtil.NormalizePath(filepath.Join(dir, "dump.bin"))
+
+	expectResult(t, client.WriteFile(path, []byte("data")), result.FileNotOpen)
+
+	if err := client.StartFile(path, goldleaf.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EndFile(goldleaf.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	// Handle was closed by EndFile.
+	expectResult(t, client.WriteFile(path, []byte("data")), result.FileNotOpen)
+}
+
+func TestHandlesClosedOnDisconnect(t *testing.T) {
+	c, client, done := newTestSession(t)
+	dir := newTestTree(t)
+
+	if err := client.StartFile(fsUtil.NormalizePath(filepath.Join(dir, "a.nsp")), goldleaf.ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.StartFile(fsUtil.NormalizePath(filepath.Join(dir, "out.bin")), goldleaf.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.files.len(); n != 2 {
+		t.Fatalf("got %v open files, want 2", n)
+	}
+
+	client.Close()
+	<-done
+
+	if n := c.files.len(); n != 0 {
+		t.Fatalf("got %v open files after disconnecting, want 0", n)
+	}
+}
+
+func TestStartFileWriteModes(t *testing.T) {
+	_, client, _ := newTestSession(t)
+	file := filepath.Join(t.TempDir(), "dump.bin")
+	path := fsUtil.NormalizePath(file)
+	if err := ioutil.WriteFile(file, []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(mode int, data string) {
+		t.Helper()
+		if err := client.StartFile(path, mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.WriteFile(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.EndFile(mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(goldleaf.ModeAppend, " data")
+	if b, _ := ioutil.ReadFile(file); string(b) != "existing data" {
+		t.Fatalf("append mode: got %q, want %q", b, "existing data")
+	}
+
+	write(goldleaf.ModeWrite, "new")
+	if b, _ := ioutil.ReadFile(file); string(b) != "new" {
+		t.Fatalf("write mode: got %q, want %q", b, "new")
+	}
+}
+
+func TestResumeInterruptedWrite(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dump.bin")
+	path := fsUtil.NormalizePath(file)
+	data := bytes.Repeat([]byte("0123456789abcdef"), BlockSize)
+	half := len(data) / 2
+
+	// First session drops after half the dump.
+	_, client, done := newTestSession(t)
+	if err := client.StartFile(path, goldleaf.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteFile(path, data[:half]); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	<-done
+
+	// Second session continues from what's on disk.
+	_, client, _ = newTestSession(t)
+	_, size, err := client.StatPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(half) {
+		t.Fatalf("got %v bytes on disk, want %v", size, half)
+	}
+	if err := client.StartFile(path, goldleaf.ModeAppend); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteFile(path, data[size:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EndFile(goldleaf.ModeAppend); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("resumed file differs, got %v bytes want %v", len(b), len(data))
+	}
+}
+
+func TestReadFileHonorsEOF(t *testing.T) {
+	_, client, _ := newTestSession(t)
+	file := filepath.Join(t.TempDir(), "big.nsp")
+	data := bytes.Repeat([]byte("goquark!"), chunkSize/4+3)
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := fsUtil.NormalizePath(file)
+
+	if err := client.StartFile(path, goldleaf.ModeRead); err != nil {
+		t.Fatal(err)
+	}
+
+	// Spans several chunks and goes past the end of the file.
+	offset := int64(5)
+	b, err := client.ReadFile(path, offset, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data[offset:]) {
+		t.Fatalf("got %v bytes, want %v", len(b), len(data)-int(offset))
+	}
+
+	// Nothing left past the end.
+	b, err = client.ReadFile(path, int64(len(data))+10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 0 {
+		t.Fatalf("got %v bytes past the end, want 0", len(b))
+	}
+
+	_, err = client.ReadFile(path, -1, 100)
+	expectResult(t, err, result.InvalidRange)
+}
+
+// Transport starting a goroutine and a channel watching the context for every
+// Read and Write. Only measures that overhead, claiming the interface and
+// opening its endpoints need a real device.
+type watchedTransport struct {
+	Transport
+	ctx context.Context
+}
+
+func (t *watchedTransport) watch() chan struct{} {
+	chDone := make(chan struct{})
+	go func() {
+		select {
+		case <-t.ctx.Done():
+		case <-chDone:
+		}
+	}()
+	return chDone
+}
+
+func (t *watchedTransport) Read(p []byte) (int, error) {
+	chDone := t.watch()
+	defer func() { chDone <- struct{}{} }()
+	return t.Transport.Read(p)
+}
+
+func (t *watchedTransport) Write(p []byte) (int, error) {
+	chDone := t.watch()
+	defer func() { chDone <- struct{}{} }()
+	return t.Transport.Write(p)
+}
+
+// Simulates an install: a 4 GiB file read sequentially in 8 MiB requests,
+// over the loopback as is and with a context watcher per transfer.
+func BenchmarkReadFile(b *testing.B) {
+	const fileSize = 4 << 30
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	file := filepath.Join(b.TempDir(), "game.nsp")
+	f, err := os.Create(file)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Sparse, so it doesn't take disk space.
+	if err := f.Truncate(fileSize); err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+
+	b.Run("Loopback", func(b *testing.B) {
+		benchmarkReadFile(b, file, fileSize, func(t Transport) Transport { return t })
+	})
+	b.Run("WatcherPerTransfer", func(b *testing.B) {
+		benchmarkReadFile(b, file, fileSize, func(t Transport) Transport {
+			return &watchedTransport{t, context.Background()}
+		})
+	})
+}
+
+func benchmarkReadFile(b *testing.B, file string, fileSize int64, wrap func(Transport) Transport) {
+	const requestSize = 8 << 20
+
+	_, client, _ := newTestSession(b, withFolders(cfg.Folder{Alias: "Bench", Path: filepath.Dir(file)}), withTransport(wrap))
+
+	path := fsUtil.NormalizePath(file)
+	if err := client.StartFile(path, goldleaf.ModeRead); err != nil {
+		b.Fatal(err)
+	}
+	p := make([]byte, requestSize)
+
+	b.SetBytes(requestSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		offset := int64(i) * requestSize % fileSize
+		if _, err := client.ReadFileInto(path, offset, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUnsupportedVersionIsRefused(t *testing.T) {
+	for _, version := range []string{"0.7.1", "1.0.0", "garbage"} {
+		_, client, _ := newTestSession(t, withVersion(version))
+
+		_, err := client.GetDriveCount()
+		expectResult(t, err, result.UnsupportedVersion)
+
+		// Refused clients stay connected and keep getting told why.
+		_, err = client.GetSpecialPathCount()
+		expectResult(t, err, result.UnsupportedVersion)
+
+		// Data following a refused command is skipped, not taken for commands.
+		err = client.WriteFile("/refused.bin", make([]byte, 3*chunkSize+1))
+		expectResult(t, err, result.UnsupportedVersion)
+		_, err = client.GetDriveCount()
+		expectResult(t, err, result.UnsupportedVersion)
+	}
+}
+
+func TestUnsupportedCommand(t *testing.T) {
+	c, client, _ := newTestSession(t)
+
+	// A command from a newer Goldleaf is refused without ending the session.
+	_, err := client.Call(goldleaf.NewRequest(uint32(SelectFile) + 1).WriteString("Home:/"))
+	expectResult(t, err, result.UnsupportedCommand)
+	// IDs are 32-bit, they must not wrap around to known ones.
+	_, err = client.Call(goldleaf.NewRequest(0x100 + uint32(GetDriveCount)))
+	expectResult(t, err, result.UnsupportedCommand)
+
+	if _, err := client.GetDriveCount(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetFileCount("/does/not/exist"); err == nil {
+		t.Fatal("expected a failure")
+	}
+
+	want := Stats{Commands: 4, Failed: 1, Unsupported: 2}
+	if got := c.Stats(); got != want {
+		t.Fatalf("got stats %+v, want %+v", got, want)
+	}
+}
+
+func TestMalformedPayload(t *testing.T) {
+	_, client, _ := newTestSession(t)
+
+	// A string claiming more characters than the block holds.
+	_, err := client.Call(goldleaf.NewRequest(uint32(StatPath)).WriteInt32(0xFFFFFFFF))
+	expectResult(t, err, result.InvalidPayload)
+
+	// WriteFile sizes are validated before anything is allocated,
+	// the data following is skipped.
+	err = client.WriteFile(fsUtil.NormalizePath(filepath.Join(t.TempDir(), "big.bin")), make([]byte, protocol.MaxWriteSize+1))
+	expectResult(t, err, result.InvalidPayload)
+
+	if _, err := client.GetDriveCount(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteFileOutOfSync(t *testing.T) {
+	for _, req := range []*goldleaf.Request{
+		// Negative size.
+		goldleaf.NewRequest(uint32(WriteFile)).WriteString("Home:/a").WriteInt64(1 << 63),
+		// Path longer than the block, the size can't be found.
+		goldleaf.NewRequest(uint32(WriteFile)).WriteInt32(0xFFFFFFFF),
+	} {
+		_, client, done := newTestSession(t)
+
+		// There's no telling where the next command starts, the session ends.
+		if _, err := client.Call(req); err == nil {
+			t.Fatal("expected the session to end")
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("the session didn't end")
+		}
+	}
+}
+
+func TestResponseBlockLimit(t *testing.T) {
+	// Magic, result, both lengths and the name leave room for this many code units.
+	const maxPath = (BlockSize - 8 - 4 - 2*4 - 4) / 2
+	released := 0
+
+	reg := NewRegistry()
+	reg.Handle(GetSpecialPath, func(ctx context.Context, req *Request) (*Response, error) {
+		var r protocol.GetSpecialPathRequest
+		if err := req.Decode(&r); err != nil {
+			return nil, err
+		}
+		path := "Home:/" + strings.Repeat("é", int(r.Index)-6)
+		resp := Reply(&protocol.GetSpecialPathResponse{Name: "Long", Path: path})
+		return resp.Stream(func(write func([]byte) error) error {
+			released++
+			return nil
+		}), nil
+	})
+	_, client, _ := newTestSession(t, withRegistry(reg))
+
+	name, path, err := client.GetSpecialPath(maxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "Long" || len([]rune(path)) != maxPath {
+		t.Fatalf("got %q and a %v characters path", name, len([]rune(path)))
+	}
+
+	// One more doesn't fit, the request fails and the session goes on.
+	_, _, err = client.GetSpecialPath(maxPath + 1)
+	expectResult(t, err, result.ResponseTooLarge)
+	_, _, err = client.GetSpecialPath(4 * maxPath)
+	expectResult(t, err, result.ResponseTooLarge)
+
+	if _, err := client.GetSpecialPathCount(); err != nil {
+		t.Fatal(err)
+	}
+	if released != 3 {
+		t.Fatalf("stream ran %v times, want 3", released)
+	}
+}
+
+func TestRequestBlockLimit(t *testing.T) {
+	_, client, _ := newTestSession(t)
+
+	// Magic, command and length leave room for this many code units.
+	const maxPath = (BlockSize - 12) / 2
+	path := "Home:/" + strings.Repeat("é", maxPath-6)
+
+	// The longest path Goldleaf can send is decoded, the filesystem then rejects it.
+	_, _, err := client.StatPath(path)
+	var r *goldleaf.ResultError
+	if !errors.As(err, &r) {
+		t.Fatalf("got %v, want a failure", err)
+	}
+	if result.Code(r.Code) == result.InvalidPayload {
+		t.Fatalf("a path filling the block was rejected as malformed")
+	}
+}
+
+func TestPathsOutsideFoldersAreDenied(t *testing.T) {
+	base := newTestTree(t)
+	served := filepath.Join(base, "sub")
+	if err := ioutil.WriteFile(filepath.Join(served, "game.nsp"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, client, _ := newTestSession(t, withFolders(cfg.Folder{Alias: "Games", Path: served}))
+
+	// Inside is served as usual.
+	if _, _, err := client.StatPath(fsUtil.NormalizePath(filepath.Join(served, "game.nsp"))); err != nil {
+		t.Fatal(err)
+	}
+
+	outside := fsUtil.NormalizePath(filepath.Join(base, "a.nsp"))
+	escaping := fsUtil.NormalizePath(served) + "/../a.nsp"
+	for _, path := range []string{outside, escaping, "Home:/../../../etc/passwd"} {
+		_, _, err := client.StatPath(path)
+		expectResult(t, err, result.AccessDenied)
+		_, err = client.ReadFile(path, 0, 1)
+		expectResult(t, err, result.AccessDenied)
+		_, err = client.GetFileCount(path)
+		expectResult(t, err, result.AccessDenied)
+		err = client.Delete(goldleaf.TypeFile, path)
+		expectResult(t, err, result.AccessDenied)
+		err = client.Rename(goldleaf.TypeFile, fsUtil.NormalizePath(filepath.Join(served, "game.nsp")), path)
+		expectResult(t, err, result.AccessDenied)
+	}
+	err := client.Create(goldleaf.TypeFile, fsUtil.NormalizePath(filepath.Join(base, "new.txt")))
+	expectResult(t, err, result.AccessDenied)
+
+	// Paths Goldleaf wouldn't send are invalid rather than outside.
+	for _, path := range []string{"relative/a.nsp", fsUtil.NormalizePath(served) + "/a\x00.nsp"} {
+		_, _, err = client.StatPath(path)
+		expectResult(t, err, result.InvalidPath)
+	}
+
+	// The served folder itself can't go away.
+	err = client.Delete(goldleaf.TypeDirectory, fsUtil.NormalizePath(served))
+	expectResult(t, err, result.AccessDenied)
+
+	// Links don't lead out either.
+	if err := os.Symlink(base, filepath.Join(served, "escape")); err == nil {
+		_, _, err = client.StatPath(fsUtil.NormalizePath(filepath.Join(served, "escape", "a.nsp")))
+		expectResult(t, err, result.AccessDenied)
+	}
+
+	if _, err := os.Stat(filepath.Join(base, "a.nsp")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(served, "game.nsp")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFolderPermissions(t *testing.T) {
+	base := t.TempDir()
+	library := filepath.Join(base, "library")
+	dumps := filepath.Join(base, "dumps")
+	for _, d := range []string{library, dumps} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(d, "a.nsp"), []byte("game"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, client, _ := newTestSession(t, withFolders(
+		cfg.Folder{Alias: "Library", Path: library, Permissions: &cfg.Permissions{Read: true}},
+		cfg.Folder{Alias: "Dumps", Path: dumps, Permissions: &cfg.Permissions{Write: true, Create: true}},
+	))
+	game := fsUtil.NormalizePath(filepath.Join(library, "a.nsp"))
+	dump := fsUtil.NormalizePath(filepath.Join(dumps, "a.nsp"))
+
+	// The library can only be browsed and read.
+	if _, err := client.GetFileCount(fsUtil.NormalizePath(library)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReadFile(game, 0, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, client.Create(goldleaf.TypeFile, fsUtil.NormalizePath(filepath.Join(library, "new.nsp"))), result.AccessDenied)
+	expectResult(t, client.Delete(goldleaf.TypeFile, game), result.AccessDenied)
+	expectResult(t, client.Rename(goldleaf.TypeFile, game, game+".old"), result.AccessDenied)
+	expectResult(t, client.StartFile(game, goldleaf.ModeWrite), result.AccessDenied)
+	expectResult(t, client.StartFile(game, goldleaf.ModeAppend), result.AccessDenied)
+
+	// Dumps can be written but not read back nor removed.
+	expectResult(t, client.StartFile(dump, goldleaf.ModeRead), result.AccessDenied)
+	_, err := client.ReadFile(dump, 0, 4)
+	expectResult(t, err, result.AccessDenied)
+	expectResult(t, client.Delete(goldleaf.TypeFile, dump), result.AccessDenied)
+	// Nor emptied by creating them again.
+	expectResult(t, client.Create(goldleaf.TypeFile, dump), result.AlreadyExists)
+	if b, err := ioutil.ReadFile(filepath.Join(dumps, "a.nsp")); err != nil || string(b) != "game" {
+		t.Fatalf("got %q. %v", b, err)
+	}
+
+	newDump := fsUtil.NormalizePath(filepath.Join(dumps, "new.bin"))
+	if err := client.StartFile(newDump, goldleaf.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteFile(newDump, []byte("dump")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EndFile(goldleaf.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving a game out of the library needs rename on both.
+	expectResult(t, client.Rename(goldleaf.TypeFile, game, fsUtil.NormalizePath(filepath.Join(dumps, "moved.nsp"))), result.AccessDenied)
+
+	if b, err := ioutil.ReadFile(filepath.Join(dumps, "new.bin")); err != nil || string(b) != "dump" {
+		t.Fatalf("got %q. %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(library, "a.nsp")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := newTestTree(t)
+	m := NewManager(context.Background(), nil, Options{ReadOnly: true})
+	_, client, _ := newTestSession(t, withFolders(cfg.Folder{Alias: "Games", Path: dir}), withSetup(func(c *command) {
+		c.readOnly = m.ReadOnly
+	}))
+
+	game := fsUtil.NormalizePath(filepath.Join(dir, "a.nsp"))
+	newFile := fsUtil.NormalizePath(filepath.Join(dir, "new.txt"))
+
+	// Reading goes on as usual.
+	if _, err := client.ReadFile(game, 0, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.StartFile(game, goldleaf.ModeRead); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EndFile(goldleaf.ModeRead); err != nil {
+		t.Fatal(err)
+	}
+
+	expectResult(t, client.Create(goldleaf.TypeFile, newFile), result.AccessDenied)
+	expectResult(t, client.Delete(goldleaf.TypeFile, game), result.AccessDenied)
+	expectResult(t, client.Rename(goldleaf.TypeFile, game, newFile), result.AccessDenied)
+	expectResult(t, client.StartFile(game, goldleaf.ModeWrite), result.AccessDenied)
+	expectResult(t, client.StartFile(game, goldleaf.ModeAppend), result.AccessDenied)
+	expectResult(t, client.WriteFile(game, []byte("data")), result.AccessDenied)
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "a.nsp")); err != nil || string(b) != "hello goldleaf" {
+		t.Fatalf("got %q. %v", b, err)
+	}
+
+	// Switching it off applies to the running session.
+	m.SetReadOnly(false)
+	if err := client.Create(goldleaf.TypeFile, newFile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteMovesToTrash(t *testing.T) {
+	dir := newTestTree(t)
+	_, client, _ := newTestSession(t, withFolders(cfg.Folder{Alias: "Games", Path: dir}))
+	trashDir := filepath.Join(dir, trash.DefaultDir)
+
+	if err := client.Delete(goldleaf.TypeFile, fsUtil.NormalizePath(filepath.Join(dir, "a.nsp"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Delete(goldleaf.TypeDirectory, fsUtil.NormalizePath(filepath.Join(dir, "sub"))); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := trash.New(fsUtil.OS, trashDir).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	real, _ := filepath.EvalSymlinks(dir)
+	if len(entries) != 2 || entries[0].Path != filepath.Join(real, "a.nsp") || entries[0].Serial != "0.10.0" {
+		t.Fatalf("got entries %+v", entries)
+	}
+
+	// Goldleaf can't see nor reach the trash.
+	n, err := client.GetDirectoryCount(fsUtil.NormalizePath(dir))
+	if err != nil || n != 0 {
+		t.Fatalf("got %v directories. %v", n, err)
+	}
+	_, _, err = client.StatPath(fsUtil.NormalizePath(trashDir))
+	expectResult(t, err, result.AccessDenied)
+	err = client.Delete(goldleaf.TypeDirectory, fsUtil.NormalizePath(trashDir))
+	expectResult(t, err, result.AccessDenied)
+	err = client.Create(goldleaf.TypeFile, fsUtil.NormalizePath(filepath.Join(trashDir, "files", "x")))
+	expectResult(t, err, result.AccessDenied)
+
+	if _, err := trash.New(fsUtil.OS, trashDir).Restore(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReadFile(fsUtil.NormalizePath(filepath.Join(dir, "a.nsp")), 0, 5); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMountedFolders(t *testing.T) {
+	local := newTestTree(t)
+	mem := fsUtil.NewMemFS()
+	games := filepath.Join(string(filepath.Separator), "mem", "games")
+	if err := fsUtil.MkdirAll(mem, filepath.Join(games, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := mem.Create(filepath.Join(games, "a.nsp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("in memory"))
+	f.Close()
+
+	folders := withFolders(cfg.Folder{Alias: "Local", Path: local}, cfg.Folder{Alias: "Memory", Path: games})
+	_, client, _ := newTestSession(t, folders, withSetup(func(c *command) {
+		c.mount = func(f cfg.Folder) fsUtil.FS {
+			if f.Alias == "Memory" {
+				return mem
+			}
+			return fsUtil.OS
+		}
+	}))
+	path := func(p ...string) string {
+		return fsUtil.NormalizePath(filepath.Join(append([]string{games}, p...)...))
+	}
+
+	// Browsing and reading.
+	if n, err := client.GetFileCount(path()); err != nil || n != 1 {
+		t.Fatalf("got %v files. %v", n, err)
+	}
+	if name, err := client.GetDirectory(path(), 0); err != nil || name != "sub" {
+		t.Fatalf("got directory %q. %v", name, err)
+	}
+	if fType, size, err := client.StatPath(path("a.nsp")); err != nil || fType != goldleaf.TypeFile || size != 9 {
+		t.Fatalf("got type %v size %v. %v", fType, size, err)
+	}
+	if b, err := client.ReadFile(path("a.nsp"), 3, 100); err != nil || string(b) != "memory" {
+		t.Fatalf("got %q. %v", b, err)
+	}
+
+	// Writing, creating, renaming and deleting.
+	if err := client.StartFile(path("sub", "dump.bin"), goldleaf.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteFile(path("sub", "dump.bin"), []byte("dump")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EndFile(goldleaf.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Create(goldleaf.TypeDirectory, path("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rename(goldleaf.TypeFile, path("sub", "dump.bin"), path("new", "dump.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fsUtil.ReadFile(mem, filepath.Join(games, "new", "dump.bin")); err != nil || string(b) != "dump" {
+		t.Fatalf("got %q. %v", b, err)
+	}
+	if err := client.Delete(goldleaf.TypeFile, path("a.nsp")); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := trash.New(mem, filepath.Join(games, trash.DefaultDir)).List(); err != nil || len(entries) != 1 {
+		t.Fatalf("got trash %v. %v", entries, err)
+	}
+	if n, err := client.GetDirectoryCount(path()); err != nil || n != 2 {
+		t.Fatalf("got %v directories. %v", n, err)
+	}
+
+	// Nothing moves between filesystems, nor leaves the mounted folder.
+	err = client.Rename(goldleaf.TypeFile, path("new", "dump.bin"), fsUtil.NormalizePath(filepath.Join(local, "dump.bin")))
+	if err == nil {
+		t.Fatal("renamed across filesystems")
+	}
+	_, _, err = client.StatPath(path("..", "other"))
+	expectResult(t, err, result.AccessDenied)
+
+	// Local folders are served as usual alongside.
+	if b, err := client.ReadFile(fsUtil.NormalizePath(filepath.Join(local, "a.nsp")), 0, 5); err != nil || string(b) != "hello" {
+		t.Fatalf("got %q. %v", b, err)
+	}
+}
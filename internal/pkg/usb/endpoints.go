@@ -0,0 +1,81 @@
+package usb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/gousb"
+)
+
+// Interface setting and bulk endpoints Goldleaf talks through.
+type endpointLayout struct {
+	intf int
+	alt  int
+	in   gousb.EndpointDesc
+	out  gousb.EndpointDesc
+}
+
+// Walks the config's interfaces looking for the first setting exposing
+// a bulk IN and a bulk OUT endpoint.
+func findEndpoints(cfg gousb.ConfigDesc) (*endpointLayout, error) {
+	for _, intf := range cfg.Interfaces {
+		for _, alt := range intf.AltSettings {
+			var in, out *gousb.EndpointDesc
+			for _, ep := range sortedEndpoints(alt) {
+				ep := ep
+				if ep.TransferType != gousb.TransferTypeBulk {
+					continue
+				}
+				if ep.Direction == gousb.EndpointDirectionIn && in == nil {
+					in = &ep
+				}
+				if ep.Direction == gousb.EndpointDirectionOut && out == nil {
+					out = &ep
+				}
+			}
+			if in == nil || out == nil {
+				continue
+			}
+
+			// GLCI/GLCO blocks must be made of whole packets.
+			for _, ep := range []*gousb.EndpointDesc{in, out} {
+				if ep.MaxPacketSize <= 0 || BlockSize%ep.MaxPacketSize != 0 {
+					return nil, fmt.Errorf("%v max packet size doesn't fit %v byte blocks. Device layout:\n%v", ep, BlockSize, describeLayout(cfg))
+				}
+			}
+
+			return &endpointLayout{
+				intf: alt.Number,
+				alt:  alt.Alternate,
+				in:   *in,
+				out:  *out,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("no interface with bulk IN and OUT endpoints. Device layout:\n%v", describeLayout(cfg))
+}
+
+func sortedEndpoints(alt gousb.InterfaceSetting) []gousb.EndpointDesc {
+	eps := make([]gousb.EndpointDesc, 0, len(alt.Endpoints))
+	for _, ep := range alt.Endpoints {
+		eps = append(eps, ep)
+	}
+	sort.Slice(eps, func(i, j int) bool { return eps[i].Address < eps[j].Address })
+	return eps
+}
+
+// Human readable layout of cfg, to diagnose devices that don't look like Goldleaf.
+func describeLayout(cfg gousb.ConfigDesc) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "  config %v\n", cfg.Number)
+	for _, intf := range cfg.Interfaces {
+		for _, alt := range intf.AltSettings {
+			fmt.Fprintf(&b, "    interface %v alt %v\n", alt.Number, alt.Alternate)
+			for _, ep := range sortedEndpoints(alt) {
+				fmt.Fprintf(&b, "      %v\n", ep)
+			}
+		}
+	}
+	return b.String()
+}
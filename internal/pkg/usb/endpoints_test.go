@@ -0,0 +1,77 @@
+package usb
+
+import (
+	"testing"
+
+	"github.com/google/gousb"
+)
+
+func TestFindEndpoints(t *testing.T) {
+	bulk := func(addr gousb.EndpointAddress, maxPacket int) gousb.EndpointDesc {
+		dir := gousb.EndpointDirectionOut
+		if addr&0x80 != 0 {
+			dir = gousb.EndpointDirectionIn
+		}
+		return gousb.EndpointDesc{
+			Address:       addr,
+			Number:        int(addr & 0x0F),
+			Direction:     dir,
+			MaxPacketSize: maxPacket,
+			TransferType:  gousb.TransferTypeBulk,
+		}
+	}
+
+	cfg := gousb.ConfigDesc{
+		Number: 1,
+		Interfaces: []gousb.InterfaceDesc{
+			{
+				Number: 0,
+				AltSettings: []gousb.InterfaceSetting{{
+					Number: 0,
+					Endpoints: map[gousb.EndpointAddress]gousb.EndpointDesc{
+						0x83: {Address: 0x83, Number: 3, Direction: gousb.EndpointDirectionIn, MaxPacketSize: 8, TransferType: gousb.TransferTypeInterrupt},
+					},
+				}},
+			},
+			{
+				Number: 1,
+				AltSettings: []gousb.InterfaceSetting{{
+					Number: 1,
+					Endpoints: map[gousb.EndpointAddress]gousb.EndpointDesc{
+						0x02: bulk(0x02, 512),
+						0x81: bulk(0x81, 512),
+					},
+				}},
+			},
+		},
+	}
+
+	l, err := findEndpoints(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.intf != 1 || l.in.Address != 0x81 || l.out.Address != 0x02 {
+		t.Fatalf("got interface %v in %v out %v", l.intf, l.in.Address, l.out.Address)
+	}
+
+	// Only the interrupt endpoint left.
+	cfg.Interfaces = cfg.Interfaces[:1]
+	if _, err := findEndpoints(cfg); err == nil {
+		t.Fatal("expected an error for a device without bulk endpoints")
+	}
+
+	// Packets that don't fit in a block.
+	cfg.Interfaces = append(cfg.Interfaces, gousb.InterfaceDesc{
+		Number: 1,
+		AltSettings: []gousb.InterfaceSetting{{
+			Number: 1,
+			Endpoints: map[gousb.EndpointAddress]gousb.EndpointDesc{
+				0x01: bulk(0x01, 1000),
+				0x81: bulk(0x81, 1000),
+			},
+		}},
+	})
+	if _, err := findEndpoints(cfg); err == nil {
+		t.Fatal("expected an error for an unexpected max packet size")
+	}
+}
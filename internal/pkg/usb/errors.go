@@ -0,0 +1,26 @@
+package usb
+
+import "errors"
+
+// Ends a session when it's unknown where the next command starts, like after
+// a WriteFile whose data size couldn't be decoded.
+var ErrOutOfSync = errors.New("out of sync with Goldleaf")
+
+// Wraps a failure of the underlying Transport.
+// Unlike any other handler error, it ends the session.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+func isTransportError(err error) bool {
+	var t *transportError
+	return errors.As(err, &t)
+}
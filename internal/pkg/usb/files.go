@@ -0,0 +1,213 @@
+package usb
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	fsUtil "github.com/bitrvmpd/goquark/internal/pkg/fs"
+	"github.com/bitrvmpd/goquark/internal/pkg/protocol"
+	"github.com/bitrvmpd/goquark/internal/pkg/result"
+)
+
+// Size of the chunks file contents are streamed in. It's a multiple of any
+// USB max packet size, so Goldleaf still sees a single transfer.
+const chunkSize = 1 << 20
+
+// Chunks are reused across requests, a multi-gigabyte install only ever
+// holds a few of them.
+var chunkPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, chunkSize)
+		return &b
+	},
+}
+
+// File modes sent by Goldleaf on StartFile and EndFile.
+const (
+	fileModeRead   = protocol.ModeRead
+	fileModeWrite  = protocol.ModeWrite
+	fileModeAppend = protocol.ModeAppend
+)
+
+// Goldleaf keeps files open either for reading or for writing,
+// EndFile only tells which of both to close.
+type access int
+
+const (
+	accessRead access = iota
+	accessWrite
+)
+
+func accessFor(mode int) access {
+	if mode == fileModeRead {
+		return accessRead
+	}
+	return accessWrite
+}
+
+type handleKey struct {
+	path   string
+	access access
+}
+
+// Files opened by Goldleaf during a session.
+// Safe for concurrent use, so they can be closed while a handler is running.
+type handles struct {
+	mu    sync.Mutex
+	files map[handleKey]fsUtil.File
+}
+
+func newHandles() *handles {
+	return &handles{files: map[handleKey]fsUtil.File{}}
+}
+
+// Opens path with the given StartFile mode, replacing any handle
+// already open for the same path and access.
+func (h *handles) open(fsys fsUtil.FS, path string, mode int) error {
+	key := handleKey{filepath.Clean(path), accessFor(mode)}
+
+	var f fsUtil.File
+	var err error
+	switch mode {
+	case fileModeRead:
+		f, err = fsys.Open(key.path)
+	case fileModeWrite:
+		// Starts from scratch.
+		f, err = fsys.OpenFile(key.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0666)
+	case fileModeAppend:
+		// Keeps whatever is there, an interrupted dump continues from its current length.
+		f, err = fsys.OpenFile(key.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	default:
+		return fmt.Errorf("%w: file mode %v", result.ErrInvalidType, mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	if mode == fileModeAppend {
+		if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+			log.Printf("INFO: Resuming %v at %v bytes", key.path, fi.Size())
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if old, ok := h.files[key]; ok {
+		closeFile(key, old)
+	}
+	h.files[key] = f
+	return nil
+}
+
+// Returns the file opened for path with the given access.
+func (h *handles) get(path string, a access) (fsUtil.File, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, ok := h.files[handleKey{filepath.Clean(path), a}]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", result.ErrFileNotOpen, path)
+	}
+	return f, nil
+}
+
+// Appends p to a file opened for writing. A failed write is rolled back,
+// so the file always ends on a chunk boundary and can be resumed from its length.
+func appendChunk(f fsUtil.File, p []byte) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(p); err != nil {
+		if tErr := f.Truncate(fi.Size()); tErr != nil {
+			log.Printf("ERROR: Couldn't roll back %v to %v bytes. %v", f.Name(), fi.Size(), tErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Flushes files opened for writing before closing them,
+// so an interrupted dump keeps everything received so far.
+func closeFile(k handleKey, f fsUtil.File) {
+	if k.access == accessWrite {
+		if err := f.Sync(); err != nil {
+			log.Printf("ERROR: Couldn't flush %v. %v", k.path, err)
+		}
+	}
+	f.Close()
+}
+
+// Closes every file opened with the given access.
+func (h *handles) closeAccess(a access) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for k, f := range h.files {
+		if k.access == a {
+			closeFile(k, f)
+			delete(h.files, k)
+		}
+	}
+}
+
+func (h *handles) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for k, f := range h.files {
+		closeFile(k, f)
+		delete(h.files, k)
+	}
+}
+
+func (h *handles) len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.files)
+}
+
+// Sends exactly n bytes of f starting at offset through write, chunkSize bytes at a time.
+// The response was already sent, so if the file can't be read anymore the
+// rest is zero filled to keep Goldleaf in sync. Only write errors are returned.
+func streamFile(write func([]byte) error, f fsUtil.File, offset int64, n int64) error {
+	bp := chunkPool.Get().(*[]byte)
+	defer chunkPool.Put(bp)
+	b := *bp
+
+	var readErr error
+	for sent := int64(0); sent < n; {
+		chunk := b
+		if n-sent < int64(len(chunk)) {
+			chunk = chunk[:n-sent]
+		}
+
+		if readErr == nil {
+			var nRead int
+			nRead, readErr = f.ReadAt(chunk, offset+sent)
+			if readErr != nil && nRead == len(chunk) {
+				// Got everything, EOF just came along.
+				readErr = nil
+			}
+			if readErr != nil {
+				log.Printf("ERROR: Couldn't read %v at %v, zero filling. %v", f.Name(), offset+sent+int64(nRead), readErr)
+				zero(chunk[nRead:])
+			}
+		} else {
+			zero(chunk)
+		}
+
+		if err := write(chunk); err != nil {
+			return err
+		}
+		sent += int64(len(chunk))
+	}
+	return nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
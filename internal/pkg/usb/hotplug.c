@@ -0,0 +1,10 @@
+#include <libusb.h>
+
+int goquarkHotplugCallback(libusb_context *ctx, libusb_device *dev, libusb_hotplug_event event, void *user_data);
+
+int goquark_hotplug_register(libusb_context *ctx, int vid, int pid, libusb_hotplug_callback_handle *handle) {
+	return libusb_hotplug_register_callback(ctx,
+		LIBUSB_HOTPLUG_EVENT_DEVICE_ARRIVED | LIBUSB_HOTPLUG_EVENT_DEVICE_LEFT,
+		0, vid, pid, LIBUSB_HOTPLUG_MATCH_ANY,
+		(libusb_hotplug_callback_fn)(&goquarkHotplugCallback), NULL, handle);
+}
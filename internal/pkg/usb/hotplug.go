@@ -0,0 +1,90 @@
+package usb
+
+/*
+#cgo pkg-config: libusb-1.0
+#include <libusb.h>
+
+int goquark_hotplug_register(libusb_context *ctx, int vid, int pid, libusb_hotplug_callback_handle *handle);
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"unsafe"
+)
+
+var errHotplugUnsupported = errors.New("libusb hotplug isn't supported on this platform")
+
+// Hotplug listeners, keyed by their libusb context. The callback can't carry
+// Go pointers, the context is the only way to find who it belongs to.
+var hotplugListeners = struct {
+	sync.Mutex
+	m map[*C.libusb_context]chan struct{}
+}{
+	m: map[*C.libusb_context]chan struct{}{},
+}
+
+//export goquarkHotplugCallback
+func goquarkHotplugCallback(ctx *C.libusb_context, dev *C.libusb_device, event C.libusb_hotplug_event, userData unsafe.Pointer) C.int {
+	hotplugListeners.Lock()
+	ch := hotplugListeners.m[ctx]
+	hotplugListeners.Unlock()
+
+	// A pending notification already covers this one.
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+
+	// Keep the callback registered.
+	return 0
+}
+
+// Signals the returned channel whenever a Switch is plugged or unplugged,
+// until ctx is done. Fails if libusb can't report hotplug events here.
+func listenHotplug(ctx context.Context) (<-chan struct{}, error) {
+	if C.libusb_has_capability(C.LIBUSB_CAP_HAS_HOTPLUG) == 0 {
+		return nil, errHotplugUnsupported
+	}
+
+	// A context of our own, gousb doesn't expose hotplug.
+	var lctx *C.libusb_context
+	if errno := C.libusb_init(&lctx); errno != 0 {
+		return nil, fmt.Errorf("libusb_init: %v", C.GoString(C.libusb_error_name(errno)))
+	}
+
+	ch := make(chan struct{}, 1)
+	hotplugListeners.Lock()
+	hotplugListeners.m[lctx] = ch
+	hotplugListeners.Unlock()
+
+	var handle C.libusb_hotplug_callback_handle
+	if errno := C.goquark_hotplug_register(lctx, C.int(VendorID), C.int(ProductID), &handle); errno != C.LIBUSB_SUCCESS {
+		hotplugListeners.Lock()
+		delete(hotplugListeners.m, lctx)
+		hotplugListeners.Unlock()
+		C.libusb_exit(lctx)
+		return nil, fmt.Errorf("libusb_hotplug_register_callback: %v", C.GoString(C.libusb_error_name(errno)))
+	}
+
+	go func() {
+		tv := C.struct_timeval{tv_usec: 250e3}
+		for ctx.Err() == nil {
+			if errno := C.libusb_handle_events_timeout_completed(lctx, &tv, nil); errno < 0 {
+				log.Printf("ERROR: Couldn't handle hotplug events. %v", C.GoString(C.libusb_error_name(errno)))
+			}
+		}
+
+		C.libusb_hotplug_deregister_callback(lctx, handle)
+		hotplugListeners.Lock()
+		delete(hotplugListeners.m, lctx)
+		hotplugListeners.Unlock()
+		C.libusb_exit(lctx)
+	}()
+
+	return ch, nil
+}
@@ -0,0 +1,269 @@
+package usb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Consoles that couldn't be opened, or whose session ended on its own after
+// a transport error for instance, are tried again after this long if they're
+// still attached.
+const retryInterval = time.Second
+
+// SessionInfo describes a console being served.
+type SessionInfo struct {
+	// Serial number, with a suffix when several consoles report the same one.
+	Key         string
+	Serial      string
+	Description string
+	Bus         int
+	Address     int
+	Since       time.Time
+
+	// Goldleaf outside the supported versions are refused.
+	Supported bool
+	Stats     Stats
+}
+
+type session struct {
+	info   SessionInfo
+	cmd    *command
+	cancel context.CancelFunc
+}
+
+// Manager serves every console reported by a Watcher, each one through
+// its own command session with its own buffers and open files.
+type Manager struct {
+	ctx     context.Context
+	watcher *Watcher
+	opts    Options
+
+	// Opens the console reported by an event. Replaced in tests.
+	open func(ctx context.Context, e Event, opts Options) (Transport, error)
+	// How long to wait before serving again a console whose session ended
+	// while still attached.
+	retry time.Duration
+
+	mu         sync.Mutex
+	sessions   map[string]*session
+	byLocation map[location]string
+	wg         sync.WaitGroup
+
+	updates chan struct{}
+
+	// Non zero while read-only, accessed atomically.
+	readOnly int32
+}
+
+func NewManager(ctx context.Context, w *Watcher, opts Options) *Manager {
+	m := &Manager{
+		ctx:        ctx,
+		watcher:    w,
+		opts:       opts,
+		open:       openDevice,
+		retry:      retryInterval,
+		sessions:   map[string]*session{},
+		byLocation: map[location]string{},
+		updates:    make(chan struct{}, 1),
+	}
+	m.SetReadOnly(opts.ReadOnly)
+	return m
+}
+
+// Makes every session refuse, or accept again, the commands changing
+// the served folders. Applies to the sessions already running too.
+func (m *Manager) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	if atomic.SwapInt32(&m.readOnly, v) != v {
+		log.Printf("INFO: Read-only mode %v", readOnly)
+	}
+}
+
+func (m *Manager) ReadOnly() bool {
+	return atomic.LoadInt32(&m.readOnly) != 0
+}
+
+// Receives whenever a session starts or ends, see Sessions.
+// Updates happening before the last one is received are coalesced.
+func (m *Manager) Updates() <-chan struct{} {
+	return m.updates
+}
+
+func (m *Manager) notify() {
+	select {
+	case m.updates <- struct{}{}:
+	default:
+	}
+}
+
+// Starts a session for every console plugged, until ctx is done.
+// Returns once every session ended.
+func (m *Manager) Run() {
+	events, cancel := m.watcher.Subscribe()
+	defer cancel()
+	defer m.wg.Wait()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			switch e.Type {
+			case DeviceConnected:
+				if err := m.start(e); err != nil {
+					log.Printf("ERROR: Couldn't serve %v. %v", e, err)
+					// It may just not be ready, like before udev sets its permissions.
+					m.wg.Add(1)
+					go func(e Event) {
+						defer m.wg.Done()
+						m.retryLater(e)
+					}(e)
+				}
+			case DeviceDisconnected:
+				m.stop(location{e.Bus, e.Address})
+			}
+		}
+	}
+}
+
+// Returns the consoles currently served, sorted by key.
+func (m *Manager) Sessions() []SessionInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	infos := make([]SessionInfo, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		info := s.info
+		info.Stats = s.cmd.Stats()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos
+}
+
+func (m *Manager) start(e Event) error {
+	l := location{e.Bus, e.Address}
+	m.mu.Lock()
+	_, ok := m.byLocation[l]
+	m.mu.Unlock()
+	if ok {
+		// Already served.
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	t, err := m.open(ctx, e, m.opts)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	serial, err := t.SerialNumber()
+	if err != nil {
+		cancel()
+		t.Close()
+		return fmt.Errorf("couldn't read serial number. %w", err)
+	}
+	desc, err := t.Description()
+	if err != nil {
+		cancel()
+		t.Close()
+		return fmt.Errorf("couldn't read description. %w", err)
+	}
+
+	_, verErr := CheckVersion(serial)
+
+	c := newCommand(ctx, t, DefaultRegistry)
+	c.readOnly = m.ReadOnly
+	if m.opts.Folders != nil {
+		c.profiles = m.opts.Folders
+	}
+	if m.opts.Mount != nil {
+		c.mount = m.opts.Mount
+	}
+
+	m.mu.Lock()
+	key := m.uniqueKey(serial)
+	m.sessions[key] = &session{
+		info: SessionInfo{
+			Key:         key,
+			Serial:      serial,
+			Description: desc,
+			Bus:         e.Bus,
+			Address:     e.Address,
+			Since:       time.Now(),
+			Supported:   verErr == nil,
+		},
+		cmd:    c,
+		cancel: cancel,
+	}
+	m.byLocation[l] = key
+	m.mu.Unlock()
+	m.notify()
+
+	log.Printf("INFO: Serving %v (%v) on bus %v address %v", key, desc, e.Bus, e.Address)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		c.ProcessUSBPackets()
+		// Not unplugged nor stopped.
+		ended := ctx.Err() == nil
+
+		m.mu.Lock()
+		delete(m.sessions, key)
+		delete(m.byLocation, l)
+		m.mu.Unlock()
+		m.notify()
+		cancel()
+		log.Printf("INFO: Stopped serving %v", key)
+
+		if ended {
+			m.retryLater(e)
+		}
+	}()
+	return nil
+}
+
+// Has the watcher report the console of e again once the retry interval
+// passed, so it's served again if it's still attached.
+func (m *Manager) retryLater(e Event) {
+	select {
+	case <-m.ctx.Done():
+	case <-time.After(m.retry):
+		log.Printf("INFO: Looking again for a Switch on bus %v address %v", e.Bus, e.Address)
+		m.watcher.Rescan(e.Bus, e.Address)
+	}
+}
+
+// Ends the session of the console at l, if any.
+func (m *Manager) stop(l location) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if key, ok := m.byLocation[l]; ok {
+		m.sessions[key].cancel()
+	}
+}
+
+// Goldleaf reports its version as serial number, so consoles running
+// the same version need telling apart. Must be called with m.mu held.
+func (m *Manager) uniqueKey(serial string) string {
+	key := serial
+	for i := 2; ; i++ {
+		if _, ok := m.sessions[key]; !ok {
+			return key
+		}
+		key = fmt.Sprintf("%v (%v)", serial, i)
+	}
+}
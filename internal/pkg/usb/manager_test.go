@@ -0,0 +1,264 @@
+package usb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/cfg"
+	fsUtil "github.com/bitrvmpd/goquark/internal/pkg/fs"
+	"github.com/bitrvmpd/goquark/internal/pkg/goldleaf"
+)
+
+// Waits until the manager serves n consoles.
+func waitSessions(t *testing.T, m *Manager, n int) []SessionInfo {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if s := m.Sessions(); len(s) == n {
+			return s
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("got %v sessions, want %v", len(m.Sessions()), n)
+	return nil
+}
+
+func TestManagerServesEveryConsole(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := newWatcher()
+	m := NewManager(ctx, w, DefaultOptions)
+
+	// Every console is an in-memory link, the first two run the same Goldleaf
+	// and the last one an unsupported one.
+	clients := map[int]*goldleaf.Client{}
+	serials := map[int]string{1: "0.10.0", 2: "0.10.0", 3: "0.9.0", 4: "1.2.0"}
+	ready := make(chan struct{}, 4)
+	m.open = func(ctx context.Context, e Event, opts Options) (Transport, error) {
+		l, client := goldleaf.Pipe("Goldleaf", serials[e.Address])
+		go func() {
+			<-ctx.Done()
+			l.Close()
+		}()
+		clients[e.Address] = client
+		ready <- struct{}{}
+		return l, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.Run()
+		close(done)
+	}()
+
+	w.update([]location{{1, 1}, {1, 2}, {1, 3}, {1, 4}})
+	for i := 0; i < 4; i++ {
+		<-ready
+	}
+	sessions := waitSessions(t, m, 4)
+	select {
+	case <-m.Updates():
+	default:
+		t.Fatal("sessions started without an update")
+	}
+
+	keys := fmt.Sprint(sessions[0].Key, ",", sessions[1].Key, ",", sessions[2].Key, ",", sessions[3].Key)
+	if keys != "0.10.0,0.10.0 (2),0.9.0,1.2.0" {
+		t.Fatalf("got sessions %v", keys)
+	}
+	if !sessions[0].Supported || sessions[3].Supported {
+		t.Fatalf("got sessions %v", sessions)
+	}
+	delete(clients, 4)
+
+	// Each console has a session of its own.
+	errs := make(chan error, len(clients))
+	for _, client := range clients {
+		go func(client *goldleaf.Client) {
+			_, err := client.GetDriveCount()
+			errs <- err
+		}(client)
+	}
+	for range clients {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Unplugging one leaves the others alone.
+	w.update([]location{{1, 1}, {1, 3}})
+	sessions = waitSessions(t, m, 2)
+	<-m.Updates()
+	if sessions[0].Address != 1 || sessions[1].Address != 3 {
+		t.Fatalf("got sessions %v", sessions)
+	}
+	if _, err := clients[1].GetDriveCount(); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	<-done
+	if n := len(m.Sessions()); n != 0 {
+		t.Fatalf("got %v sessions after stopping, want 0", n)
+	}
+}
+
+func TestManagerServesAgainAfterTransportErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The console never goes away.
+	w := newWatcher()
+	scan := func() ([]location, error) { return []location{{1, 1}}, nil }
+	go w.run(ctx, scan, nil)
+
+	m := NewManager(ctx, w, DefaultOptions)
+	m.retry = 10 * time.Millisecond
+	clients := make(chan *goldleaf.Client, 2)
+	m.open = func(ctx context.Context, e Event, opts Options) (Transport, error) {
+		l, client := goldleaf.Pipe("Goldleaf", "0.10.0")
+		go func() {
+			<-ctx.Done()
+			l.Close()
+		}()
+		clients <- client
+		return l, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.Run()
+		close(done)
+	}()
+
+	// The link breaks while the console stays plugged.
+	first := <-clients
+	waitSessions(t, m, 1)
+	first.Close()
+
+	var second *goldleaf.Client
+	select {
+	case second = <-clients:
+	case <-time.After(time.Second):
+		t.Fatal("the console wasn't served again")
+	}
+	waitSessions(t, m, 1)
+	if _, err := second.GetDriveCount(); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestManagerRetriesConsolesFailingToOpen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := newWatcher()
+	scan := func() ([]location, error) { return []location{{1, 1}}, nil }
+	go w.run(ctx, scan, nil)
+
+	m := NewManager(ctx, w, DefaultOptions)
+	m.retry = 10 * time.Millisecond
+	opened := 0
+	clients := make(chan *goldleaf.Client, 1)
+	m.open = func(ctx context.Context, e Event, opts Options) (Transport, error) {
+		// Not accessible yet the first time.
+		if opened++; opened == 1 {
+			return nil, errors.New("LIBUSB_ERROR_ACCESS")
+		}
+		l, client := goldleaf.Pipe("Goldleaf", "0.10.0")
+		go func() {
+			<-ctx.Done()
+			l.Close()
+		}()
+		clients <- client
+		return l, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.Run()
+		close(done)
+	}()
+
+	select {
+	case client := <-clients:
+		waitSessions(t, m, 1)
+		if _, err := client.GetDriveCount(); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the console wasn't opened again")
+	}
+
+	cancel()
+	<-done
+}
+
+func TestManagerMountsFolders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mem := fsUtil.NewMemFS()
+	games := filepath.Join(string(filepath.Separator), "games")
+	if err := mem.Mkdir(games, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newWatcher()
+	opts := DefaultOptions
+	opts.Folders = func(serial string, product string) (string, []cfg.Folder) {
+		return "memory", []cfg.Folder{{Alias: "Games", Path: games}}
+	}
+	opts.Mount = func(f cfg.Folder) fsUtil.FS {
+		return mem
+	}
+	m := NewManager(ctx, w, opts)
+	clients := make(chan *goldleaf.Client, 1)
+	m.open = func(ctx context.Context, e Event, opts Options) (Transport, error) {
+		l, client := goldleaf.Pipe("Goldleaf", "0.10.0")
+		go func() {
+			<-ctx.Done()
+			l.Close()
+		}()
+		clients <- client
+		return l, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.Run()
+		close(done)
+	}()
+	w.update([]location{{1, 1}})
+	client := <-clients
+	waitSessions(t, m, 1)
+
+	// Goldleaf writes to the folder in memory.
+	dump := fsUtil.NormalizePath(filepath.Join(games, "dump.bin"))
+	if err := client.StartFile(dump, goldleaf.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteFile(dump, []byte("dump")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EndFile(goldleaf.ModeWrite); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fsUtil.ReadFile(mem, filepath.Join(games, "dump.bin")); err != nil || string(b) != "dump" {
+		t.Fatalf("got %q. %v", b, err)
+	}
+	if n, err := client.GetFileCount(fsUtil.NormalizePath(games)); err != nil || n != 1 {
+		t.Fatalf("got %v files. %v", n, err)
+	}
+
+	cancel()
+	<-done
+}
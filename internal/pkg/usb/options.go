@@ -0,0 +1,35 @@
+package usb
+
+import (
+	"time"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/cfg"
+	fsUtil "github.com/bitrvmpd/goquark/internal/pkg/fs"
+)
+
+// Options tweak how goQuark serves Goldleaf.
+type Options struct {
+	// Maximum time a single USB read may take once Goldleaf started sending.
+	// Zero waits forever.
+	ReadTimeout time.Duration
+
+	// Maximum time a single USB write may take. Zero waits forever.
+	WriteTimeout time.Duration
+
+	// Refuses every command changing the served folders.
+	// Can be switched later with Manager.SetReadOnly.
+	ReadOnly bool
+
+	// Picks the profile and folders served to a console from its serial
+	// number and product string. The configured ones, cfg.FoldersFor, when nil.
+	Folders func(serial string, product string) (string, []cfg.Folder)
+
+	// Returns the filesystem a served folder lives in, like a fs.MemFS.
+	// The local one when nil.
+	Mount func(f cfg.Folder) fsUtil.FS
+}
+
+var DefaultOptions = Options{
+	ReadTimeout:  30 * time.Second,
+	WriteTimeout: 30 * time.Second,
+}
@@ -0,0 +1,77 @@
+package usb
+
+import (
+	"context"
+	"sync"
+)
+
+// HandlerFunc serves a command sent by Goldleaf. A nil Response sends an
+// empty one, an error sends Goldleaf a failure with its result code instead.
+type HandlerFunc func(ctx context.Context, req *Request) (*Response, error)
+
+// Middleware wraps the handler of every command, built-in ones included.
+// Used for logging, authorization or metrics.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Registry holds the handlers added on top of the built-in commands
+// and the middleware run around all of them.
+// Changes only apply to sessions started afterwards.
+type Registry struct {
+	mu         sync.RWMutex
+	handlers   map[ID]HandlerFunc
+	middleware []Middleware
+}
+
+func NewRegistry() *Registry {
+	return &Registry{handlers: map[ID]HandlerFunc{}}
+}
+
+// DefaultRegistry is used by every session started by NewWithTransport.
+var DefaultRegistry = NewRegistry()
+
+// Serves id with h. Takes precedence over the built-in handler,
+// if there's one, so experimental commands can be tried without forking.
+func (r *Registry) Handle(id ID, h HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[id] = h
+}
+
+// Appends mw to the middleware. The first one added is the outermost.
+func (r *Registry) Use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middleware = append(r.middleware, mw...)
+}
+
+// Handle registers h for id on the DefaultRegistry.
+func Handle(id ID, h HandlerFunc) {
+	DefaultRegistry.Handle(id, h)
+}
+
+// Use adds mw to the DefaultRegistry.
+func Use(mw ...Middleware) {
+	DefaultRegistry.Use(mw...)
+}
+
+// Merges builtin with the registered handlers, wrapping all of them in the middleware.
+func (r *Registry) build(builtin map[ID]HandlerFunc) map[ID]HandlerFunc {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	handlers := make(map[ID]HandlerFunc, len(builtin)+len(r.handlers))
+	for id, h := range builtin {
+		handlers[id] = h
+	}
+	for id, h := range r.handlers {
+		handlers[id] = h
+	}
+
+	for id, h := range handlers {
+		for i := len(r.middleware) - 1; i >= 0; i-- {
+			h = r.middleware[i](h)
+		}
+		handlers[id] = h
+	}
+	return handlers
+}
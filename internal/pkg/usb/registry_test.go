@@ -0,0 +1,116 @@
+package usb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/goldleaf"
+	"github.com/bitrvmpd/goquark/internal/pkg/result"
+)
+
+const cmdEcho ID = 0x100
+
+func TestRegistryCustomCommand(t *testing.T) {
+	reg := NewRegistry()
+	reg.Handle(cmdEcho, func(ctx context.Context, req *Request) (*Response, error) {
+		s, err := req.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		n, err := req.ReadInt32()
+		if err != nil {
+			return nil, err
+		}
+		if req.Serial != "0.10.0" {
+			return nil, fmt.Errorf("unexpected serial %v", req.Serial)
+		}
+		return NewResponse().WriteString(strings.Repeat(s, n)), nil
+	})
+	_, client, _ := newTestSession(t, withRegistry(reg))
+
+	res, err := client.Call(goldleaf.NewRequest(uint32(cmdEcho)).WriteString("ab").WriteInt32(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := res.ReadString(); err != nil || s != "ababab" {
+		t.Fatalf("got %q, %v", s, err)
+	}
+
+	// Built-in commands are still served.
+	if _, err := client.GetSpecialPathCount(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryOverridesBuiltin(t *testing.T) {
+	reg := NewRegistry()
+	reg.Handle(GetDriveCount, func(ctx context.Context, req *Request) (*Response, error) {
+		return nil, fmt.Errorf("no drives for you. %w", os.ErrPermission)
+	})
+	_, client, _ := newTestSession(t, withRegistry(reg))
+
+	_, err := client.GetDriveCount()
+	expectResult(t, err, result.AccessDenied)
+}
+
+func TestRegistryStream(t *testing.T) {
+	reg := NewRegistry()
+	reg.Handle(cmdEcho, func(ctx context.Context, req *Request) (*Response, error) {
+		return NewResponse().WriteInt64(5).Stream(func(write func([]byte) error) error {
+			return write([]byte("hello"))
+		}), nil
+	})
+	_, client, _ := newTestSession(t, withRegistry(reg))
+
+	res, err := client.Call(goldleaf.NewRequest(uint32(cmdEcho)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := res.ReadInt64(); err != nil || n != 5 {
+		t.Fatalf("got %v, %v", n, err)
+	}
+	b := make([]byte, 5)
+	if err := client.ReadRaw(b); err != nil || string(b) != "hello" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+}
+
+func TestRegistryMiddleware(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, req *Request) (*Response, error) {
+				calls = append(calls, fmt.Sprintf("%v:%v", name, req.ID))
+				return next(ctx, req)
+			}
+		}
+	}
+	errDenied := fmt.Errorf("denied. %w", os.ErrPermission)
+	deny := func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *Request) (*Response, error) {
+			if req.ID == Delete {
+				return nil, errDenied
+			}
+			return next(ctx, req)
+		}
+	}
+
+	reg := NewRegistry()
+	reg.Use(trace("outer"), trace("inner"))
+	reg.Use(deny)
+	_, client, _ := newTestSession(t, withRegistry(reg))
+
+	if _, err := client.GetDriveCount(); err != nil {
+		t.Fatal(err)
+	}
+	err := client.Delete(goldleaf.TypeFile, "/does/not/matter")
+	expectResult(t, err, result.AccessDenied)
+
+	want := "outer:GetDriveCount,inner:GetDriveCount,outer:Delete,inner:Delete"
+	if got := strings.Join(calls, ","); got != want {
+		t.Fatalf("got calls %v, want %v", got, want)
+	}
+}
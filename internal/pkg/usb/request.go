@@ -0,0 +1,85 @@
+package usb
+
+import "github.com/bitrvmpd/goquark/internal/pkg/protocol"
+
+// Request is a command sent by Goldleaf. Its payload is decoded in the
+// order the command defines it.
+type Request struct {
+	ID ID
+	// Goldleaf's description and version, as reported over USB.
+	Description string
+	Serial      string
+
+	buf *buffer
+}
+
+func (r *Request) ReadInt32() (int, error) {
+	return r.buf.readInt32()
+}
+
+func (r *Request) ReadInt64() (int64, error) {
+	return r.buf.readInt64()
+}
+
+func (r *Request) ReadString() (string, error) {
+	return r.buf.readString()
+}
+
+// Decodes the payload into m.
+func (r *Request) Decode(m protocol.Message) error {
+	return m.Decode(r.buf.in)
+}
+
+// Reads data Goldleaf sends right after the command block, like WriteFile's contents.
+func (r *Request) ReadRaw(p []byte) error {
+	return r.buf.readRaw(p)
+}
+
+// StreamFunc sends data right after the response block through write.
+type StreamFunc func(write func(p []byte) error) error
+
+// Response is sent to Goldleaf once a handler succeeds.
+type Response struct {
+	out    protocol.Encoder
+	stream StreamFunc
+}
+
+func NewResponse() *Response {
+	return &Response{}
+}
+
+// Returns a response carrying m.
+func Reply(m protocol.Message) *Response {
+	return NewResponse().Encode(m)
+}
+
+func (r *Response) WriteInt32(n uint32) *Response {
+	r.out.Uint32(n)
+	return r
+}
+
+func (r *Response) WriteInt64(n uint64) *Response {
+	r.out.Uint64(n)
+	return r
+}
+
+func (r *Response) WriteString(v string) *Response {
+	r.out.String(v)
+	return r
+}
+
+// Appends m to the response.
+func (r *Response) Encode(m protocol.Message) *Response {
+	m.Encode(&r.out)
+	return r
+}
+
+// Sets s to be run once the response was sent, for data not fitting in it
+// like file contents. Goldleaf can't be told about failures anymore by then,
+// so an error returned by s ends the session.
+// s runs even if the response couldn't be sent, with write failing,
+// so it can always release what it holds.
+func (r *Response) Stream(s StreamFunc) *Response {
+	r.stream = s
+	return r
+}
@@ -0,0 +1,24 @@
+package usb
+
+import "sync/atomic"
+
+// Stats counts the commands Goldleaf sent during a session.
+type Stats struct {
+	// Every command received, failed and unsupported ones included.
+	Commands    uint64
+	Failed      uint64
+	Unsupported uint64
+}
+
+// Counters are only written by the session but may be read by anyone.
+func (s *Stats) add(n *uint64) {
+	atomic.AddUint64(n, 1)
+}
+
+func (s *Stats) snapshot() Stats {
+	return Stats{
+		Commands:    atomic.LoadUint64(&s.Commands),
+		Failed:      atomic.LoadUint64(&s.Failed),
+		Unsupported: atomic.LoadUint64(&s.Unsupported),
+	}
+}
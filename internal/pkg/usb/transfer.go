@@ -0,0 +1,138 @@
+package usb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/gousb"
+)
+
+// Returned by USBInterface when the Switch was unplugged or stopped responding.
+// The session is over, goQuark goes back to waiting for a device.
+var ErrDeviceLost = errors.New("device lost")
+
+var errTimeout = errors.New("transfer timed out")
+
+// Standard requests used to check and recover the device.
+// gousb leaves the standard request type out, it's 0 per the USB spec.
+const (
+	controlStandard     = 0x00
+	requestGetStatus    = 0x00
+	requestClearFeature = 0x01
+	featureEndpointHalt = 0x00
+)
+
+func (u *USBInterface) Read(p []byte) (int, error) {
+	// Bulk transfers may come in shorter than requested, keep reading
+	// until p is full.
+	n := 0
+	stalled := false
+	for n < len(p) {
+		numBytes, err := u.transfer(u.opts.ReadTimeout, func(ctx context.Context) (int, error) {
+			return u.inEp.ReadContext(ctx, p[n:])
+		})
+		n += numBytes
+		if err == nil {
+			continue
+		}
+
+		// Nothing received yet, Goldleaf is just idle between commands.
+		// Keep waiting as long as the device is still there.
+		if errors.Is(err, errTimeout) && n == 0 {
+			if pErr := u.probe(); pErr != nil {
+				return n, fmt.Errorf("%w: %v", ErrDeviceLost, pErr)
+			}
+			continue
+		}
+
+		if !stalled && isStall(err) {
+			stalled = true
+			if err = u.clearHalt(u.inEp.Desc.Address); err == nil {
+				continue
+			}
+		}
+		return n, u.transferError(err)
+	}
+	return n, nil
+}
+
+func (u *USBInterface) Write(p []byte) (int, error) {
+	n := 0
+	stalled := false
+	for n < len(p) {
+		numBytes, err := u.transfer(u.opts.WriteTimeout, func(ctx context.Context) (int, error) {
+			return u.outEp.WriteContext(ctx, p[n:])
+		})
+		n += numBytes
+		if err == nil {
+			continue
+		}
+
+		if !stalled && isStall(err) {
+			stalled = true
+			if err = u.clearHalt(u.outEp.Desc.Address); err == nil {
+				continue
+			}
+		}
+		return n, u.transferError(err)
+	}
+	return n, nil
+}
+
+// Runs a single transfer, bounded by timeout when it's set.
+func (u *USBInterface) transfer(timeout time.Duration, f func(ctx context.Context) (int, error)) (int, error) {
+	ctx := u.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(u.ctx, timeout)
+		defer cancel()
+	}
+
+	n, err := f(ctx)
+	if err != nil && u.ctx.Err() == nil && ctx.Err() == context.DeadlineExceeded {
+		return n, errTimeout
+	}
+	return n, err
+}
+
+// Classifies transfer errors, anything meaning the device is gone becomes ErrDeviceLost.
+func (u *USBInterface) transferError(err error) error {
+	if u.ctx.Err() != nil {
+		return u.ctx.Err()
+	}
+	switch {
+	case errors.Is(err, errTimeout),
+		errors.Is(err, gousb.TransferNoDevice),
+		errors.Is(err, gousb.ErrorNoDevice),
+		errors.Is(err, gousb.TransferStall),
+		errors.Is(err, gousb.ErrorPipe),
+		errors.Is(err, gousb.TransferError),
+		errors.Is(err, gousb.ErrorIO):
+		return fmt.Errorf("%w: %v", ErrDeviceLost, err)
+	}
+	return err
+}
+
+func isStall(err error) bool {
+	return errors.Is(err, gousb.TransferStall) || errors.Is(err, gousb.ErrorPipe)
+}
+
+// Clears a halted endpoint so transfers can go on.
+func (u *USBInterface) clearHalt(addr gousb.EndpointAddress) error {
+	log.Printf("INFO: Endpoint %v stalled, clearing halt", addr)
+	rType := uint8(gousb.ControlOut | controlStandard | gousb.ControlEndpoint)
+	if _, err := u.gDev.Control(rType, requestClearFeature, featureEndpointHalt, uint16(addr), nil); err != nil {
+		return fmt.Errorf("couldn't clear halt on %v. %w", addr, err)
+	}
+	return nil
+}
+
+// Checks the device still answers, GET_STATUS is supported by every device.
+func (u *USBInterface) probe() error {
+	rType := uint8(gousb.ControlIn | controlStandard | gousb.ControlDevice)
+	_, err := u.gDev.Control(rType, requestGetStatus, 0, 0, make([]byte, 2))
+	return err
+}
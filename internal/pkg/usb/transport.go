@@ -0,0 +1,25 @@
+package usb
+
+// Transport moves raw blocks between goQuark and a Goldleaf client.
+// USBInterface is the gousb backed implementation, other backends
+// (in-memory, TCP, recordings) only need to satisfy this interface.
+type Transport interface {
+	// Blocks until a client is available.
+	// Returns false when there are no more clients to serve.
+	Connect() bool
+
+	// Reads exactly len(p) bytes from the client.
+	Read(p []byte) (int, error)
+
+	// Writes p to the client.
+	Write(p []byte) (int, error)
+
+	// Releases the current client.
+	Close()
+
+	// Client's description, Goldleaf reports it as the USB product string.
+	Description() (string, error)
+
+	// Client's serial number, Goldleaf reports its version here.
+	SerialNumber() (string, error)
+}
@@ -4,188 +4,161 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"time"
 
 	"github.com/google/gousb"
 )
 
 const (
-	VendorID      = 0x057E
-	ProductID     = 0x3000
-	WriteEndpoint = 0x1
-	ReadEndpoint  = 0x81
+	VendorID  = 0x057E
+	ProductID = 0x3000
 )
 
+var _ Transport = (*USBInterface)(nil)
+
+// USBInterface is a single Switch, opened when it was reported by the Watcher.
 type USBInterface struct {
-	ctx  context.Context
-	gCtx *gousb.Context
-	gDev *gousb.Device
+	ctx    context.Context
+	opts   Options
+	served bool
+	gCtx   *gousb.Context
+	gDev   *gousb.Device
+
+	// Claimed once per connection, released by Close.
+	intf  *gousb.Interface
+	done  func()
+	inEp  *gousb.InEndpoint
+	outEp *gousb.OutEndpoint
 }
 
-func initDevice(ctx context.Context) *USBInterface {
+func initDevice(ctx context.Context, opts Options) *USBInterface {
 	return &USBInterface{
-		ctx: ctx,
+		ctx:  ctx,
+		opts: opts,
+	}
+}
+
+// Opens and claims the Switch reported by e.
+func openDevice(ctx context.Context, e Event, opts Options) (Transport, error) {
+	u := initDevice(ctx, opts)
+	if err := u.open(e); err != nil {
+		return nil, err
 	}
+	return u, nil
 }
 
 func (u *USBInterface) Close() {
+	if u.gDev == nil {
+		return
+	}
+	if u.done != nil {
+		u.done()
+	}
 	u.gDev.Close()
 	u.gCtx.Close()
+	u.intf, u.done, u.inEp, u.outEp = nil, nil, nil, nil
+	u.gDev, u.gCtx = nil, nil
 	log.Println("Closing gDev and gCtx")
 }
 
-// Waits for a device to be connected that matches VID: 0x057E PID: 0x3000
-// Stores context and device for reuse.
-func (u *USBInterface) isConnected() chan bool {
-	// Set ticker to search for the required device
-	ticker := time.NewTicker(500 * time.Millisecond)
-	c := make(chan bool)
-
-	go func() {
-		fmt.Println("Waiting for USB device to appear...")
-
-		// Initialize a new Context.
-		gctx := gousb.NewContext()
-
-		for range ticker.C {
-			select {
-			case <-u.ctx.Done():
-				gctx.Close()
-				c <- false
-				return
-			case <-ticker.C:
-				// Open any device with a given VID/PID using a convenience function.
-				// If none is found, it returns nil and nil error
-				dev, _ := gctx.OpenDeviceWithVIDPID(VendorID, ProductID)
-				if dev != nil {
-					// Device found, exit loop. don't close it!
-					u.gCtx = gctx
-					u.gDev = dev
-					c <- true
-					return
-				}
-			}
-		}
-	}()
-	return c
-}
-
-func (u *USBInterface) getDescription() (string, error) {
-	s, err := u.gDev.Product()
+// Claims Goldleaf's interface and opens its endpoints for the whole connection.
+// Endpoints are discovered from the active config descriptor.
+func (u *USBInterface) claim() error {
+	n, err := u.gDev.ActiveConfigNum()
 	if err != nil {
-		return "", err
+		return fmt.Errorf("%s.ActiveConfigNum(): %w", u.gDev, err)
 	}
-	return s, nil
-}
 
-func (u *USBInterface) getSerialNumber() (string, error) {
-	s, err := u.gDev.SerialNumber()
+	cfgDesc, ok := u.gDev.Desc.Configs[n]
+	if !ok {
+		return fmt.Errorf("%s has no descriptor for active config %v", u.gDev, n)
+	}
+
+	layout, err := findEndpoints(cfgDesc)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("%s: %w", u.gDev, err)
 	}
-	return s, nil
-}
 
-func (u *USBInterface) Read(p []byte) (int, error) {
-	//Test donde channel for each request.
-	chDone := make(chan interface{})
+	cfg, err := u.gDev.Config(n)
+	if err != nil {
+		return fmt.Errorf("%s.Config(%v): %w", u.gDev, n, err)
+	}
 
-	// Claim the default interface using a convenience function.
-	// The default interface is always #0 alt #0 in the currently active
-	// config.
-	intf, done, err := u.gDev.DefaultInterface()
+	intf, err := cfg.Interface(layout.intf, layout.alt)
 	if err != nil {
-		log.Fatalf("%s.DefaultInterface(): %v", u.gDev, err)
+		cfg.Close()
+		return fmt.Errorf("%s.Interface(%v, %v): %w", cfg, layout.intf, layout.alt, err)
+	}
+	done := func() {
+		intf.Close()
+		cfg.Close()
 	}
-	defer done()
 
 	// Open an IN endpoint.
-	ep, err := intf.InEndpoint(ReadEndpoint)
+	inEp, err := intf.InEndpoint(layout.in.Number)
 	if err != nil {
-		log.Fatalf("%s.OutEndpoint(%v): %v", intf, WriteEndpoint, err)
-	}
-
-	// Set transfer as bulk
-	//ep.Desc.MaxPacketSize = BlockSize
-	ep.Desc.TransferType = gousb.TransferTypeBulk
-	ep.Desc.IsoSyncType = gousb.IsoSyncTypeSync
-	ep.Desc.PollInterval = 0 * time.Millisecond
-
-	// Just before reading, prepare a way to cancel this request
-	go func() {
-		for {
-			select {
-			case <-u.ctx.Done():
-				done()
-				u.Close()
-				return
-			case <-chDone:
-				// Successful read, close this goroutine
-				return
-			}
-		}
-	}()
-	// Read data from the USB device.
-	numBytes, err := ep.Read(p)
-	if err != nil {
-		return 0, err
+		done()
+		return fmt.Errorf("%s.InEndpoint(%v): %w", intf, layout.in.Number, err)
 	}
 
-	if numBytes != len(p) {
-		log.Fatalf("%s.Read([%v]): only %d bytes read, returned error is %v", ep, numBytes, numBytes, err)
+	// Open an OUT endpoint.
+	outEp, err := intf.OutEndpoint(layout.out.Number)
+	if err != nil {
+		done()
+		return fmt.Errorf("%s.OutEndpoint(%v): %w", intf, layout.out.Number, err)
 	}
 
-	// Notify that we are done!
-	chDone <- struct{}{}
-	return numBytes, nil
+	u.intf, u.done, u.inEp, u.outEp = intf, done, inEp, outEp
+	return nil
 }
 
-func (u *USBInterface) Write(p []byte) (int, error) {
-	//Test donde channel for each request.
-	chDone := make(chan interface{})
+// The device is already open, so it's served once until it's closed.
+func (u *USBInterface) Connect() bool {
+	if u.served || u.gDev == nil {
+		return false
+	}
+	u.served = true
+	return true
+}
 
-	// Claim the default interface using a convenience function.
-	// The default interface is always #0 alt #0 in the currently active
-	// config.
-	intf, done, err := u.gDev.DefaultInterface()
-	if err != nil {
-		log.Fatalf("%s.DefaultInterface(): %v", u.gDev, err)
+// Opens and claims the device reported by e.
+func (u *USBInterface) open(e Event) error {
+	gctx := gousb.NewContext()
+	devs, err := gctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		return desc.Bus == e.Bus && desc.Address == e.Address &&
+			desc.Vendor == VendorID && desc.Product == ProductID
+	})
+	if len(devs) == 0 {
+		gctx.Close()
+		if err == nil {
+			err = fmt.Errorf("%v is gone", e)
+		}
+		return err
 	}
-	defer done()
 
-	// Open an OUT endpoint.
-	ep, err := intf.OutEndpoint(WriteEndpoint)
+	// Device found, don't close it!
+	u.gCtx = gctx
+	u.gDev = devs[0]
+	if err := u.claim(); err != nil {
+		u.gDev.Close()
+		gctx.Close()
+		u.gDev, u.gCtx = nil, nil
+		return fmt.Errorf("couldn't claim device. %w", err)
+	}
+	return nil
+}
+
+func (u *USBInterface) Description() (string, error) {
+	s, err := u.gDev.Product()
 	if err != nil {
-		log.Fatalf("%s.OutEndpoint(%v): %v", intf, WriteEndpoint, err)
-	}
-
-	// Set transfer as bulk
-	//ep.Desc.MaxPacketSize = BlockSize
-	ep.Desc.TransferType = gousb.TransferTypeBulk
-	ep.Desc.IsoSyncType = gousb.IsoSyncTypeSync
-	ep.Desc.PollInterval = 0 * time.Millisecond
-
-	// Just before writting, prepare a way to cancel this request
-	go func() {
-		for {
-			select {
-			case <-u.ctx.Done():
-				done()
-				u.Close()
-				return
-			case <-chDone:
-				// Successful read, close this goroutine
-				return
-			}
-		}
-	}()
-	// Write data to the USB device.
-	numBytes, err := ep.Write(p)
-	if numBytes != len(p) {
-		log.Fatalf("%s.Write([%v]): only %d bytes written, returned error is %v", ep, numBytes, numBytes, err)
+		return "", err
 	}
+	return s, nil
+}
 
-	// Notify that we are done!
-	chDone <- struct{}{}
-	return numBytes, nil
+func (u *USBInterface) SerialNumber() (string, error) {
+	s, err := u.gDev.SerialNumber()
+	if err != nil {
+		return "", err
+	}
+	return s, nil
 }
@@ -0,0 +1,29 @@
+package usb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/gousb"
+)
+
+func TestTransferError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	u := initDevice(ctx, DefaultOptions)
+
+	for _, err := range []error{errTimeout, gousb.TransferNoDevice, gousb.ErrorNoDevice, gousb.TransferStall} {
+		if got := u.transferError(err); !errors.Is(got, ErrDeviceLost) {
+			t.Errorf("transferError(%v) = %v, want ErrDeviceLost", err, got)
+		}
+	}
+	if got := u.transferError(gousb.ErrorOverflow); errors.Is(got, ErrDeviceLost) {
+		t.Errorf("transferError(%v) = %v, want it untouched", gousb.ErrorOverflow, got)
+	}
+
+	// Once cancelled, nothing is a device loss.
+	cancel()
+	if got := u.transferError(gousb.TransferCancelled); got != context.Canceled {
+		t.Errorf("transferError after cancel = %v, want context.Canceled", got)
+	}
+}
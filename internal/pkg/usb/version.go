@@ -0,0 +1,114 @@
+package usb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/result"
+)
+
+// Goldleaf reports its version as USB serial number. Only the versions
+// speaking the same Quark protocol as goQuark are served.
+const (
+	QuarkVersion       = "0.4.0"
+	MinGoldleafVersion = "0.8.0"
+	// First Goldleaf version not supported anymore.
+	MaxGoldleafVersion = "1.0.0"
+)
+
+// Version is a semantic version, build metadata is dropped.
+type Version struct {
+	Major, Minor, Patch int
+	Pre                 string
+}
+
+// Parses versions like "0.10.0", "v1.0" or "1.0.0-beta+abc".
+// A missing minor or patch number counts as 0.
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	str := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(str, '+'); i >= 0 {
+		str = str[:i]
+	}
+	if i := strings.IndexByte(str, '-'); i >= 0 {
+		str, v.Pre = str[:i], str[i+1:]
+		if v.Pre == "" {
+			return Version{}, fmt.Errorf("invalid version %q. empty pre-release", s)
+		}
+	}
+
+	parts := strings.Split(str, ".")
+	if len(parts) > 3 {
+		return Version{}, fmt.Errorf("invalid version %q. too many numbers", s)
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || strings.HasPrefix(p, "+") {
+			return Version{}, fmt.Errorf("invalid version %q. %q isn't a number", s, p)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+// Returns -1, 0 or 1 when v is older, the same or newer than o.
+// Pre-releases are older than their release.
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+
+	switch {
+	case v.Pre == o.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case o.Pre == "":
+		return -1
+	case v.Pre < o.Pre:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%v.%v.%v", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+func mustParseVersion(s string) Version {
+	v, err := ParseVersion(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+var (
+	minGoldleaf = mustParseVersion(MinGoldleafVersion)
+	maxGoldleaf = mustParseVersion(MaxGoldleafVersion)
+)
+
+// Parses the serial number reported by Goldleaf and checks it's supported.
+func CheckVersion(serial string) (Version, error) {
+	v, err := ParseVersion(serial)
+	if err != nil {
+		return Version{}, fmt.Errorf("%w: %v", result.ErrUnsupportedVersion, err)
+	}
+	if v.Compare(minGoldleaf) < 0 || v.Compare(maxGoldleaf) >= 0 {
+		return v, fmt.Errorf("%w: Goldleaf %v, goQuark %v needs >= %v and < %v",
+			result.ErrUnsupportedVersion, v, QuarkVersion, MinGoldleafVersion, MaxGoldleafVersion)
+	}
+	return v, nil
+}
@@ -0,0 +1,67 @@
+package usb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bitrvmpd/goquark/internal/pkg/result"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Version
+	}{
+		{"0.10.0", Version{0, 10, 0, ""}},
+		{"v1.0", Version{1, 0, 0, ""}},
+		{"0.8", Version{0, 8, 0, ""}},
+		{"1.0.0-beta+abc", Version{1, 0, 0, "beta"}},
+		{" 0.9.1 ", Version{0, 9, 1, ""}},
+	}
+	for _, tt := range tests {
+		got, err := ParseVersion(tt.in)
+		if err != nil {
+			t.Fatalf("ParseVersion(%q): %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Errorf("ParseVersion(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "Goldleaf", "1.x.0", "1.2.3.4", "1.-2", "1.+2", "1.0-"} {
+		if v, err := ParseVersion(in); err == nil {
+			t.Errorf("ParseVersion(%q) = %v, want error", in, v)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	ordered := []string{"0.8.0", "0.9.0", "0.10.0-alpha", "0.10.0-beta", "0.10.0", "0.10.1", "1.0.0"}
+	for i := range ordered {
+		for j := range ordered {
+			a, b := mustParseVersion(ordered[i]), mustParseVersion(ordered[j])
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := a.Compare(b); got != want {
+				t.Errorf("%v.Compare(%v) = %v, want %v", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	for _, s := range []string{MinGoldleafVersion, "0.9.0", "0.10.0"} {
+		if _, err := CheckVersion(s); err != nil {
+			t.Errorf("CheckVersion(%q): %v", s, err)
+		}
+	}
+	for _, s := range []string{"0.7.9", "0.8.0-beta", MaxGoldleafVersion, "2.0", "unknown"} {
+		if _, err := CheckVersion(s); !errors.Is(err, result.ErrUnsupportedVersion) {
+			t.Errorf("CheckVersion(%q) = %v, want unsupported", s, err)
+		}
+	}
+}
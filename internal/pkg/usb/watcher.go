@@ -0,0 +1,276 @@
+package usb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/gousb"
+)
+
+// Interval used to look for devices when hotplug isn't available.
+const pollInterval = 500 * time.Millisecond
+
+type EventType int
+
+const (
+	DeviceConnected EventType = iota
+	DeviceDisconnected
+)
+
+func (t EventType) String() string {
+	if t == DeviceConnected {
+		return "connected"
+	}
+	return "disconnected"
+}
+
+// Event reports a Switch being plugged or unplugged.
+// Devices are identified by where they sit, their serial needs them opened.
+type Event struct {
+	Type    EventType
+	Bus     int
+	Address int
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("Switch %v on bus %v address %v", e.Type, e.Bus, e.Address)
+}
+
+type location struct {
+	bus     int
+	address int
+}
+
+// Watcher keeps track of the Switch consoles attached to this machine.
+// It relies on libusb hotplug events and falls back to polling where they
+// aren't supported.
+type Watcher struct {
+	mu      sync.Mutex
+	present map[location]bool
+	subs    map[*subscriber]struct{}
+	closed  bool
+
+	// Asks for a scan outside of the triggers.
+	rescan chan struct{}
+}
+
+// Events wait in pending until the subscriber takes them, so a slow one
+// misses none and never holds the watcher back.
+type subscriber struct {
+	ch      chan Event
+	pending []Event
+	// Signaled when pending grows or the watcher stops.
+	wake chan struct{}
+	// Closed when the subscriber stops receiving.
+	done chan struct{}
+	// Set once the watcher stopped, the channel closes when pending is empty.
+	closing bool
+}
+
+// Starts watching until ctx is done.
+func NewWatcher(ctx context.Context) *Watcher {
+	w := newWatcher()
+
+	triggers, err := listenHotplug(ctx)
+	if err != nil {
+		log.Printf("INFO: Polling for devices, hotplug unavailable. %v", err)
+		triggers = tick(ctx, pollInterval)
+	}
+
+	go func() {
+		gctx := gousb.NewContext()
+		defer gctx.Close()
+		w.run(ctx, func() ([]location, error) { return scanDevices(gctx) }, triggers)
+	}()
+	return w
+}
+
+func newWatcher() *Watcher {
+	return &Watcher{
+		present: map[location]bool{},
+		subs:    map[*subscriber]struct{}{},
+		rescan:  make(chan struct{}, 1),
+	}
+}
+
+// Returns a channel with an event for every device already attached followed
+// by every change from now on, and a function to stop receiving them.
+// The channel is closed once the watcher stops.
+func (w *Watcher) Subscribe() (<-chan Event, func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := &subscriber{
+		ch:      make(chan Event),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		closing: w.closed,
+	}
+	for l := range w.present {
+		s.pending = append(s.pending, Event{Type: DeviceConnected, Bus: l.bus, Address: l.address})
+	}
+	if !w.closed {
+		w.subs[s] = struct{}{}
+	}
+	go w.deliver(s)
+
+	var once sync.Once
+	return s.ch, func() {
+		once.Do(func() {
+			w.mu.Lock()
+			delete(w.subs, s)
+			w.mu.Unlock()
+			close(s.done)
+		})
+	}
+}
+
+// Hands the pending events of s over in order, until it stops receiving
+// or the watcher stops.
+func (w *Watcher) deliver(s *subscriber) {
+	defer close(s.ch)
+	for {
+		w.mu.Lock()
+		if len(s.pending) == 0 {
+			closing := s.closing
+			w.mu.Unlock()
+			if closing {
+				return
+			}
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		e := s.pending[0]
+		s.pending = s.pending[1:]
+		w.mu.Unlock()
+
+		select {
+		case s.ch <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Rescans whenever triggered, until ctx is done.
+func (w *Watcher) run(ctx context.Context, scan func() ([]location, error), triggers <-chan struct{}) {
+	defer w.close()
+
+	for {
+		if devs, err := scan(); err != nil {
+			log.Printf("ERROR: Couldn't list USB devices. %v", err)
+		} else {
+			w.update(devs)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-triggers:
+		case <-w.rescan:
+		}
+	}
+}
+
+// Forgets the device at bus and address and scans again, so it's reported
+// connected anew if it's still attached.
+func (w *Watcher) Rescan(bus int, address int) {
+	w.mu.Lock()
+	delete(w.present, location{bus, address})
+	w.mu.Unlock()
+
+	select {
+	case w.rescan <- struct{}{}:
+	default:
+	}
+}
+
+// Compares devs with what was there before and notifies the differences.
+func (w *Watcher) update(devs []location) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	found := map[location]bool{}
+	for _, l := range devs {
+		found[l] = true
+		if !w.present[l] {
+			w.present[l] = true
+			w.notify(Event{Type: DeviceConnected, Bus: l.bus, Address: l.address})
+		}
+	}
+
+	for l := range w.present {
+		if !found[l] {
+			delete(w.present, l)
+			w.notify(Event{Type: DeviceDisconnected, Bus: l.bus, Address: l.address})
+		}
+	}
+}
+
+// Must be called with w.mu held. Never blocks the watcher, events queue up
+// until each subscriber takes them.
+func (w *Watcher) notify(e Event) {
+	for s := range w.subs {
+		s.pending = append(s.pending, e)
+		s.signal()
+	}
+}
+
+func (s *subscriber) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Watcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	for s := range w.subs {
+		delete(w.subs, s)
+		s.closing = true
+		s.signal()
+	}
+}
+
+// Lists attached consoles without opening them.
+func scanDevices(gctx *gousb.Context) ([]location, error) {
+	var devs []location
+	_, err := gctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+		if desc.Vendor == VendorID && desc.Product == ProductID {
+			devs = append(devs, location{desc.Bus, desc.Address})
+		}
+		return false
+	})
+	return devs, err
+}
+
+// Signals the returned channel every d until ctx is done.
+func tick(ctx context.Context, d time.Duration) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				select {
+				case ch <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
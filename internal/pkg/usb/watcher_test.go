@@ -0,0 +1,103 @@
+package usb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return Event{}
+}
+
+func TestWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := newWatcher()
+
+	// Each trigger moves to the next scan result.
+	scans := make(chan []location, 1)
+	scans <- []location{{1, 4}}
+	triggers := make(chan struct{})
+	scan := func() ([]location, error) { return <-scans, nil }
+
+	stopped := make(chan struct{})
+	go func() {
+		w.run(ctx, scan, triggers)
+		close(stopped)
+	}()
+
+	// Wait for the first scan to be applied.
+	first, stop := w.Subscribe()
+	e := nextEvent(t, first)
+	stop()
+	if e != (Event{DeviceConnected, 1, 4}) {
+		t.Fatalf("got %v", e)
+	}
+
+	// Late subscribers learn about devices already there.
+	events, stop := w.Subscribe()
+	defer stop()
+	if e := nextEvent(t, events); e != (Event{DeviceConnected, 1, 4}) {
+		t.Fatalf("got %v", e)
+	}
+
+	scans <- []location{{1, 4}, {2, 7}}
+	triggers <- struct{}{}
+	if e := nextEvent(t, events); e != (Event{DeviceConnected, 2, 7}) {
+		t.Fatalf("got %v", e)
+	}
+
+	scans <- []location{{2, 7}}
+	triggers <- struct{}{}
+	if e := nextEvent(t, events); e != (Event{DeviceDisconnected, 1, 4}) {
+		t.Fatalf("got %v", e)
+	}
+
+	cancel()
+	<-stopped
+	if _, ok := <-events; ok {
+		t.Fatal("expected events to be closed once the watcher stops")
+	}
+}
+
+func TestWatcherKeepsEventsForSlowSubscribers(t *testing.T) {
+	w := newWatcher()
+	events, stop := w.Subscribe()
+	defer stop()
+
+	// A burst of plugs while nobody receives.
+	var devs []location
+	for i := 1; i <= 100; i++ {
+		devs = append(devs, location{1, i})
+		w.update(devs)
+	}
+	w.update(nil)
+
+	connected, disconnected := map[int]bool{}, map[int]bool{}
+	for i := 0; i < 200; i++ {
+		e := nextEvent(t, events)
+		if e.Type == DeviceConnected {
+			if len(disconnected) > 0 {
+				t.Fatalf("got %v after a disconnection", e)
+			}
+			connected[e.Address] = true
+		} else {
+			disconnected[e.Address] = true
+		}
+	}
+	if len(connected) != 100 || len(disconnected) != 100 {
+		t.Fatalf("got %v connected and %v disconnected, want 100 each", len(connected), len(disconnected))
+	}
+
+	w.close()
+	if _, ok := <-events; ok {
+		t.Fatal("expected events to be closed once the watcher stops")
+	}
+}